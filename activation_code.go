@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ref: https://www.gsma.com/esim/wp-content/uploads/2020/06/SGP.22-v2.2.2.pdf#page=111
+const (
+	activationCodeScheme    = "LPA:"
+	activationCodeFormat    = "1"
+	activationCodeDelimiter = "$"
+	activationCodeMaxLen    = 255
+	// AC_Format, SM-DP+ Address, AC_Token, SM-DP+ OID, Confirmation Code Required Flag
+	activationCodeMaxFields = 5
+)
+
+var (
+	fqdnLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+	// 允许除空白和控制字符以外的 ASCII 字符，排除激活码的分隔符 $
+	// 以及设备输入时分隔确认码的 #，否则 AB#12 会被当作 Matching ID AB 和确认码 12
+	matchIDRegexp = regexp.MustCompile(`^[!"%-~]+$`)
+	oidRegexp     = regexp.MustCompile(`^[0-2](\.(0|[1-9][0-9]*))+$`)
+)
+
+type ActivationCode struct {
+	PullInfo
+	ConfirmCodeRequired bool
+}
+
+type ActivationCodeError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ActivationCodeError) Error() string {
+	if e.Field == "" {
+		return "LPA Activation Code format error: " + e.Reason
+	}
+	return "LPA Activation Code format error: " + e.Field + " " + e.Reason
+}
+
+// ParseActivationCode 按照 SGP.22 4.1 解析并校验激活码
+func ParseActivationCode(code string) (*ActivationCode, error) {
+	code = strings.TrimSpace(code)
+	code, ok := strings.CutPrefix(code, activationCodeScheme)
+	if !ok {
+		return nil, &ActivationCodeError{Reason: "must start with " + activationCodeScheme}
+	}
+	if len(code) > activationCodeMaxLen {
+		return nil, &ActivationCodeError{Reason: fmt.Sprint("longer than ", activationCodeMaxLen, " characters")}
+	}
+	parts := strings.Split(code, activationCodeDelimiter)
+	if parts[0] != activationCodeFormat {
+		return nil, &ActivationCodeError{Field: "AC_Format", Reason: fmt.Sprintf("%q is not supported", parts[0])}
+	}
+	if len(parts) < 2 {
+		return nil, &ActivationCodeError{Field: "SM-DP+ Address", Reason: "is missing"}
+	}
+	if len(parts) > activationCodeMaxFields {
+		return nil, &ActivationCodeError{Reason: fmt.Sprint("too many fields (", len(parts), " > ", activationCodeMaxFields, ")")}
+	}
+	// 补齐可选字段
+	for len(parts) < activationCodeMaxFields {
+		parts = append(parts, "")
+	}
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	ac := &ActivationCode{}
+	smdp, err := validateFQDN(parts[1])
+	if err != nil {
+		return nil, &ActivationCodeError{Field: "SM-DP+ Address", Reason: err.Error()}
+	}
+	ac.SMDP = smdp
+	if parts[2] != "" && !matchIDRegexp.MatchString(parts[2]) {
+		return nil, &ActivationCodeError{Field: "AC_Token", Reason: "may only contain printable ASCII characters except $ and #"}
+	}
+	ac.MatchID = parts[2]
+	if parts[3] != "" && !oidRegexp.MatchString(parts[3]) {
+		return nil, &ActivationCodeError{Field: "SM-DP+ OID", Reason: fmt.Sprintf("%q is not a valid OID", parts[3])}
+	}
+	ac.ObjectID = parts[3]
+	switch parts[4] {
+	case "":
+	case "1":
+		ac.ConfirmCodeRequired = true
+	default:
+		return nil, &ActivationCodeError{Field: "Confirmation Code Required Flag", Reason: fmt.Sprintf("must be 1, got %q", parts[4])}
+	}
+	return ac, nil
+}
+
+// validateFQDN 校验 SM-DP+ 地址并返回小写形式
+func validateFQDN(fqdn string) (string, error) {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if fqdn == "" {
+		return "", fmt.Errorf("is missing")
+	}
+	if len(fqdn) > 253 {
+		return "", fmt.Errorf("is longer than 253 characters")
+	}
+	labels := strings.Split(fqdn, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("%q is not a fully qualified domain name", fqdn)
+	}
+	for _, label := range labels {
+		if !fqdnLabelRegexp.MatchString(label) {
+			return "", fmt.Errorf("%q has invalid label %q", fqdn, label)
+		}
+	}
+	return strings.ToLower(fqdn), nil
+}
+
+// String 编码为规范形式的激活码，省略末尾的空字段
+func (ac *ActivationCode) String() string {
+	return EncodeActivationCode(ac.PullInfo, ac.ConfirmCodeRequired)
+}
+
+// EncodeActivationCode 将 PullInfo 编码为 LPA:1$... 形式的激活码
+func EncodeActivationCode(info PullInfo, confirmCodeRequired bool) string {
+	fields := []string{activationCodeFormat, strings.ToLower(info.SMDP), info.MatchID, info.ObjectID, ""}
+	if confirmCodeRequired {
+		fields[4] = "1"
+	}
+	for len(fields) > 2 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return activationCodeScheme + strings.Join(fields, activationCodeDelimiter)
+}
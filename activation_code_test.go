@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseActivationCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		want  PullInfo
+		cc    bool
+		field string // 期望出错的字段，"" 表示不出错
+		err   bool
+	}{
+		{name: "address only", code: "LPA:1$rsp.example.com", want: PullInfo{SMDP: "rsp.example.com"}},
+		{name: "matching id", code: "LPA:1$rsp.example.com$ABC-123", want: PullInfo{SMDP: "rsp.example.com", MatchID: "ABC-123"}},
+		{name: "address lowercased", code: "LPA:1$RSP.Example.COM$X", want: PullInfo{SMDP: "rsp.example.com", MatchID: "X"}},
+		{name: "trailing dot", code: "LPA:1$rsp.example.com.$X", want: PullInfo{SMDP: "rsp.example.com", MatchID: "X"}},
+		{name: "lowercase and underscore matching id", code: "LPA:1$rsp.example.com$ab_cd-12", want: PullInfo{SMDP: "rsp.example.com", MatchID: "ab_cd-12"}},
+		{name: "fields trimmed", code: "LPA:1$ rsp.example.com $ ABC $ $ 1 ", want: PullInfo{SMDP: "rsp.example.com", MatchID: "ABC"}, cc: true},
+		{name: "oid", code: "LPA:1$rsp.example.com$ABC$1.3.6.1.4.1.31746", want: PullInfo{SMDP: "rsp.example.com", MatchID: "ABC", ObjectID: "1.3.6.1.4.1.31746"}},
+		{name: "cc flag 1", code: "LPA:1$rsp.example.com$ABC$$1", want: PullInfo{SMDP: "rsp.example.com", MatchID: "ABC"}, cc: true},
+		{name: "cc flag empty", code: "LPA:1$rsp.example.com$ABC$$", want: PullInfo{SMDP: "rsp.example.com", MatchID: "ABC"}},
+		{name: "cc flag 0", code: "LPA:1$rsp.example.com$ABC$$0", field: "Confirmation Code Required Flag", err: true},
+		{name: "too many fields", code: "LPA:1$rsp.example.com$ABC$$1$extra", err: true},
+		{name: "missing scheme", code: "1$rsp.example.com$ABC", err: true},
+		{name: "unsupported format", code: "LPA:2$rsp.example.com$ABC", field: "AC_Format", err: true},
+		{name: "missing address", code: "LPA:1", field: "SM-DP+ Address", err: true},
+		{name: "empty address", code: "LPA:1$$ABC", field: "SM-DP+ Address", err: true},
+		{name: "not fully qualified", code: "LPA:1$localhost$ABC", field: "SM-DP+ Address", err: true},
+		{name: "invalid label", code: "LPA:1$-rsp.example.com$ABC", field: "SM-DP+ Address", err: true},
+		{name: "invalid character in address", code: "LPA:1$rsp_1.example.com$ABC", field: "SM-DP+ Address", err: true},
+		{name: "space in matching id", code: "LPA:1$rsp.example.com$AB CD", field: "AC_Token", err: true},
+		{name: "non ascii matching id", code: "LPA:1$rsp.example.com$ABCé", field: "AC_Token", err: true},
+		{name: "hash in matching id", code: "LPA:1$rsp.example.com$AB#12", field: "AC_Token", err: true},
+		{name: "control character in matching id", code: "LPA:1$rsp.example.com$AB\x11CD", field: "AC_Token", err: true},
+		{name: "invalid oid", code: "LPA:1$rsp.example.com$ABC$1.x", field: "SM-DP+ OID", err: true},
+		{name: "oid leading zero", code: "LPA:1$rsp.example.com$ABC$1.03", field: "SM-DP+ OID", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac, err := ParseActivationCode(tt.code)
+			if tt.err {
+				var acErr *ActivationCodeError
+				if !errors.As(err, &acErr) {
+					t.Fatalf("ParseActivationCode(%q) error = %v, want ActivationCodeError", tt.code, err)
+				}
+				if tt.field != "" && acErr.Field != tt.field {
+					t.Fatalf("ParseActivationCode(%q) field = %q, want %q", tt.code, acErr.Field, tt.field)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseActivationCode(%q) error = %v", tt.code, err)
+			}
+			if ac.PullInfo != tt.want {
+				t.Errorf("ParseActivationCode(%q) = %+v, want %+v", tt.code, ac.PullInfo, tt.want)
+			}
+			if ac.ConfirmCodeRequired != tt.cc {
+				t.Errorf("ParseActivationCode(%q) ConfirmCodeRequired = %v, want %v", tt.code, ac.ConfirmCodeRequired, tt.cc)
+			}
+		})
+	}
+}
+
+func TestParseActivationCodeTooLong(t *testing.T) {
+	code := "LPA:1$rsp.example.com$"
+	for len(code) <= activationCodeMaxLen+len(activationCodeScheme) {
+		code += "A"
+	}
+	if _, err := ParseActivationCode(code); err == nil {
+		t.Fatal("expected error for activation code longer than 255 characters")
+	}
+}
+
+func TestEncodeActivationCode(t *testing.T) {
+	tests := []struct {
+		info PullInfo
+		cc   bool
+		want string
+	}{
+		{info: PullInfo{SMDP: "rsp.example.com"}, want: "LPA:1$rsp.example.com"},
+		{info: PullInfo{SMDP: "RSP.example.com", MatchID: "ABC"}, want: "LPA:1$rsp.example.com$ABC"},
+		{info: PullInfo{SMDP: "rsp.example.com", MatchID: "ABC"}, cc: true, want: "LPA:1$rsp.example.com$ABC$$1"},
+		{info: PullInfo{SMDP: "rsp.example.com", ObjectID: "1.2.3"}, want: "LPA:1$rsp.example.com$$1.2.3"},
+		{info: PullInfo{SMDP: "rsp.example.com", MatchID: "ab_c", ObjectID: "1.2.3"}, cc: true, want: "LPA:1$rsp.example.com$ab_c$1.2.3$1"},
+	}
+	for _, tt := range tests {
+		got := EncodeActivationCode(tt.info, tt.cc)
+		if got != tt.want {
+			t.Errorf("EncodeActivationCode(%+v, %v) = %q, want %q", tt.info, tt.cc, got, tt.want)
+			continue
+		}
+		// 编码结果再解析应得到相同的内容
+		ac, err := ParseActivationCode(got)
+		if err != nil {
+			t.Errorf("ParseActivationCode(%q) error = %v", got, err)
+			continue
+		}
+		want := tt.info
+		want.SMDP = ac.SMDP
+		if ac.PullInfo != want || ac.ConfirmCodeRequired != tt.cc {
+			t.Errorf("round trip of %q = %+v cc=%v, want %+v cc=%v", got, ac.PullInfo, ac.ConfirmCodeRequired, want, tt.cc)
+		}
+		if ac.String() != got {
+			t.Errorf("ActivationCode.String() = %q, want %q", ac.String(), got)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 const (
 	TypeExecute = 0
 	TypeFinish  = 1
@@ -12,6 +17,8 @@ const (
 type ShellRequest struct {
 	Type    int    `json:"type"`
 	Command string `json:"command"`
+	// Args 直接作为 lpac 参数，优先于 Command
+	Args []string `json:"args"`
 }
 
 type ShellResponse struct {
@@ -19,3 +26,114 @@ type ShellResponse struct {
 	Stdout map[string]interface{} `json:"stdout"`
 	Stderr string                 `json:"stderr"`
 }
+
+type ConfirmCodeRequest struct {
+	MatchingID       string `json:"matching_id"`
+	ConfirmationCode string `json:"confirmation_code"`
+	// 有效期，单位秒
+	TTL int `json:"ttl"`
+}
+
+type ConfirmCodeResponse struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type QRCodeResponse struct {
+	ActivationCode string       `json:"activation_code"`
+	Result         *ShellResult `json:"result"`
+}
+
+// ShellResult lpac 原始结果，失败时附带解析后的错误
+type ShellResult struct {
+	*Payload
+	Error *LpacError `json:"error,omitempty"`
+}
+
+type PendingRequest struct {
+	ActivationCode   string `json:"activation_code"`
+	ConfirmationCode string `json:"confirmation_code"`
+	// 有效期，单位秒
+	TTL int `json:"ttl"`
+}
+
+type PendingResponse struct {
+	PIN       string    `json:"pin"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Profile struct {
+	ICCID           string `json:"iccid"`
+	ISDPAID         string `json:"isdp_aid"`
+	State           string `json:"state"`
+	Nickname        string `json:"nickname"`
+	ServiceProvider string `json:"service_provider"`
+	Name            string `json:"name"`
+	Class           string `json:"class"`
+	IconType        string `json:"icon_type,omitempty"`
+	Icon            string `json:"icon,omitempty"`
+}
+
+type ProfileActionResponse struct {
+	ICCID  string `json:"iccid"`
+	Action string `json:"action"`
+}
+
+type NicknameRequest struct {
+	Nickname string `json:"nickname"`
+}
+
+type ChipInfo struct {
+	EID         string          `json:"eid"`
+	DefaultSMDP string          `json:"default_smdp"`
+	RootSMDS    string          `json:"root_smds"`
+	EUICCInfo2  json.RawMessage `json:"euicc_info2"`
+}
+
+type LeaseResponse struct {
+	Lease     string    `json:"lease"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type SessionInfo struct {
+	ID               string     `json:"id"`
+	RemoteAddr       string     `json:"remote_addr"`
+	ConnectedAt      time.Time  `json:"connected_at"`
+	WorkMode         string     `json:"work_mode"`
+	Role             string     `json:"role"`
+	APILocked        bool       `json:"api_locked"`
+	KeepAliveExpires *time.Time `json:"keepalive_expires_at"`
+	LpacRunning      bool       `json:"lpac_running"`
+	LpacArgs         []string   `json:"lpac_args,omitempty"`
+	EID              string     `json:"eid,omitempty"`
+	Profiles         []Profile  `json:"profiles"`
+}
+
+// AdminSession 管理 API 中的 RLPA 连接信息
+type AdminSession struct {
+	Serial       uint64    `json:"serial"`
+	ManageID     string    `json:"manage_id,omitempty"`
+	RemoteAddr   string    `json:"remote_addr"`
+	WorkMode     string    `json:"work_mode"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	DurationMS   int64     `json:"duration_ms"`
+	EID          string    `json:"eid,omitempty"`
+	APILocked    bool      `json:"api_locked"`
+	LpacPID      int       `json:"lpac_pid,omitempty"`
+	LpacArgs     []string  `json:"lpac_args,omitempty"`
+	APDUSent     int64     `json:"apdu_sent"`
+	APDUReceived int64     `json:"apdu_received"`
+}
+
+type MessageBoxRequest struct {
+	Text string `json:"text"`
+}
+
+type BanRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
@@ -2,54 +2,587 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
+// Config 运行配置，加载后不再修改，重新加载时整体替换
+// 优先级：默认值 < 配置文件 < 环境变量 < 命令行参数
 type Config struct {
-	SocketPort  uint16
-	APIPort     uint16
+	SocketPort        uint16
+	SocketListen      []string
+	SocketTLSPort     uint16
+	SocketTLSListen   []string
+	SocketTLSCert     string
+	SocketTLSKey      string
+	SocketTLSClientCA string
+	ProxyTrusted      []netip.Prefix
+
+	APIPort        uint16
+	APIListen      []string
+	APITLSCert     string
+	APITLSKey      string
+	APITLSClientCA string
+	// APIUnixSocketMode Unix socket 文件的权限
+	APIUnixSocketMode os.FileMode
+	AdminToken        string
+	MetricsToken      string
+	PolicyFile        string
+
+	LpacFolder  string
 	LpacExeName string
 	LpacPath    string
+	LpacEnv     []string
+
+	KeepaliveTimeout time.Duration
+	LpacTimeout      time.Duration
+	HandshakeTimeout time.Duration
+
+	PendingPINLength int
+	PendingStoreFile string
+	MessageLang      string
+	LogLevel         slog.Level
+
+	ManageIDLength  int
+	ManageIDCharset string
+	PasswordLength  int
+	PasswordCharset string
+	PasswordWords   int
+
+	AuthMaxFailures int
+	IPBanFailures   int
+	IPBanDuration   time.Duration
+
+	Features Features
+}
+
+// Features 可以关闭的 API 功能
+type Features struct {
+	QRCode       bool
+	Pending      bool
+	Provisioning bool
+	Jobs         bool
+	Events       bool
+	V1           bool
+	Admin        bool
+	Metrics      bool
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// CFG 返回当前配置，不要修改返回的值
+func CFG() *Config {
+	return currentConfig.Load()
+}
+
+// setting 一项配置，key 为配置文件中的键，env 和 flag 为对应的环境变量和命令行参数
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
 }
 
-var CFG Config
+var settings = []setting{
+	{key: "socket.port", env: "SOCKET_PORT", flag: "socket-port", usage: "rlpa socket port, 0 to disable, default 1888",
+		set: portSetting(func(c *Config) *uint16 { return &c.SocketPort }, func(c *Config) *[]string { return &c.SocketListen })},
+	{key: "socket.listen", env: "SOCKET_LISTEN", flag: "socket-listen", usage: "comma separated rlpa socket addresses like 0.0.0.0:1888,[::]:1888, overrides SOCKET_PORT",
+		set: listenSetting(false, func(c *Config) *[]string { return &c.SocketListen })},
+	{key: "socket.tls_port", env: "SOCKET_TLS_PORT", usage: "tls rlpa socket port, disabled if 0",
+		set: portSetting(func(c *Config) *uint16 { return &c.SocketTLSPort }, func(c *Config) *[]string { return &c.SocketTLSListen })},
+	{key: "socket.tls_listen", env: "SOCKET_TLS_LISTEN", usage: "comma separated tls rlpa socket addresses, overrides SOCKET_TLS_PORT",
+		set: listenSetting(false, func(c *Config) *[]string { return &c.SocketTLSListen })},
+	{key: "socket.tls_cert", env: "SOCKET_TLS_CERT", usage: "certificate file of tls rlpa socket",
+		set: stringSetting(func(c *Config) *string { return &c.SocketTLSCert })},
+	{key: "socket.tls_key", env: "SOCKET_TLS_KEY", usage: "private key file of tls rlpa socket",
+		set: stringSetting(func(c *Config) *string { return &c.SocketTLSKey })},
+	{key: "socket.tls_client_ca", env: "SOCKET_TLS_CLIENT_CA", usage: "require client certificates signed by this CA",
+		set: stringSetting(func(c *Config) *string { return &c.SocketTLSClientCA })},
+	{key: "socket.proxy_trusted", env: "SOCKET_PROXY_TRUSTED", usage: "comma separated ips or cidrs of load balancers sending PROXY protocol headers",
+		set: func(c *Config, value string) error {
+			var trusted []netip.Prefix
+			for _, item := range strings.Split(value, ",") {
+				item = strings.TrimSpace(item)
+				if item == "" {
+					continue
+				}
+				prefix, err := parseProxyTrusted(item)
+				if err != nil {
+					return err
+				}
+				trusted = append(trusted, prefix)
+			}
+			c.ProxyTrusted = trusted
+			return nil
+		}},
 
-func InitConfig() error {
+	{key: "api.port", env: "API_PORT", flag: "api-port", usage: "http management api port, default 8008",
+		set: portSetting(func(c *Config) *uint16 { return &c.APIPort }, func(c *Config) *[]string { return &c.APIListen })},
+	{key: "api.listen", env: "API_LISTEN", flag: "api-listen", usage: "comma separated api addresses like 127.0.0.1:8008 or unix:/run/rlpa-server.sock, overrides API_PORT",
+		set: listenSetting(true, func(c *Config) *[]string { return &c.APIListen })},
+	{key: "api.unix_socket_mode", env: "API_UNIX_SOCKET_MODE", usage: "octal permissions of api unix sockets, default 0660",
+		set: func(c *Config, value string) error {
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return errors.New("must be an octal file mode like 0660")
+			}
+			c.APIUnixSocketMode = os.FileMode(mode)
+			return nil
+		}},
+	{key: "api.tls_cert", env: "API_TLS_CERT", usage: "certificate file, serve the api over https if set",
+		set: stringSetting(func(c *Config) *string { return &c.APITLSCert })},
+	{key: "api.tls_key", env: "API_TLS_KEY", usage: "private key file of the https api",
+		set: stringSetting(func(c *Config) *string { return &c.APITLSKey })},
+	{key: "api.tls_client_ca", env: "API_TLS_CLIENT_CA", usage: "admin api requires client certificates signed by this CA",
+		set: stringSetting(func(c *Config) *string { return &c.APITLSClientCA })},
+	{key: "api.admin_token", env: "ADMIN_TOKEN", usage: "token for admin api, admin api is disabled if empty",
+		set: stringSetting(func(c *Config) *string { return &c.AdminToken })},
+	{key: "api.metrics_token", env: "METRICS_TOKEN", usage: "token for /metrics, /metrics is public if this and the admin token are empty",
+		set: stringSetting(func(c *Config) *string { return &c.MetricsToken })},
+	{key: "api.policy_file", env: "POLICY_FILE", usage: "json file of lpac commands allowed through api",
+		set: stringSetting(func(c *Config) *string { return &c.PolicyFile })},
+
+	{key: "lpac.folder", env: "LPAC_FOLDER", flag: "lpac-folder", usage: "lpac binary folder, default working directory",
+		set: stringSetting(func(c *Config) *string { return &c.LpacFolder })},
+	{key: "lpac.timeout", env: "LPAC_TIMEOUT", usage: "kill lpac after this duration, 0 to disable, default 10m",
+		set: durationSetting(0, func(c *Config) *time.Duration { return &c.LpacTimeout })},
+
+	{key: "timeouts.keepalive", env: "KEEPALIVE_TIMEOUT", usage: "api lease expires without keepalive, default 60s",
+		set: durationSetting(time.Second, func(c *Config) *time.Duration { return &c.KeepaliveTimeout })},
+	{key: "timeouts.tls_handshake", env: "TLS_HANDSHAKE_TIMEOUT", usage: "tls handshake timeout of rlpa socket, default 10s",
+		set: durationSetting(time.Second, func(c *Config) *time.Duration { return &c.HandshakeTimeout })},
+
+	{key: "pending.pin_length", env: "PENDING_PIN_LENGTH", usage: "digits of pending download PIN, 6 to 16, default 8",
+		set: intSetting(minPendingPINLength, maxPendingPINLength, func(c *Config) *int { return &c.PendingPINLength })},
+	{key: "pending.store_file", env: "PENDING_STORE_FILE", usage: "persist pending downloads to this json file",
+		set: stringSetting(func(c *Config) *string { return &c.PendingStoreFile })},
+
+	{key: "message_lang", env: "MESSAGE_LANG", usage: "language of messagebox errors, en or zh",
+		set: func(c *Config, value string) error {
+			lang := strings.ToLower(value)
+			if _, ok := lpacErrorMessages[lang]; !ok {
+				return errors.New("unsupported language " + value)
+			}
+			c.MessageLang = lang
+			return nil
+		}},
+	{key: "log_level", env: "LOG_LEVEL", flag: "log-level", usage: "debug, info, warn or error, default info",
+		set: func(c *Config, value string) error {
+			return c.LogLevel.UnmarshalText([]byte(value))
+		}},
+
+	{key: "credentials.id_length", env: "MANAGE_ID_LENGTH", usage: "length of ManageID, default 4",
+		set: intSetting(4, 32, func(c *Config) *int { return &c.ManageIDLength })},
+	{key: "credentials.id_charset", env: "MANAGE_ID_CHARSET", usage: "characters of ManageID, letters, digits and -._~ only",
+		set: charsetSetting(true, func(c *Config) *string { return &c.ManageIDCharset })},
+	{key: "credentials.password_length", env: "PASSWORD_LENGTH", usage: "length of password, default 8",
+		set: intSetting(4, 64, func(c *Config) *int { return &c.PasswordLength })},
+	{key: "credentials.password_charset", env: "PASSWORD_CHARSET", usage: "characters of password, default digits",
+		set: charsetSetting(false, func(c *Config) *string { return &c.PasswordCharset })},
+	{key: "credentials.password_words", env: "PASSWORD_WORDS", usage: "use a passphrase of this many words instead, 0 to disable",
+		set: intSetting(0, 12, func(c *Config) *int { return &c.PasswordWords })},
+	{key: "credentials.auth_max_failures", env: "AUTH_MAX_FAILURES", usage: "wrong passwords before a ManageID is replaced, default 5",
+		set: intSetting(1, 1000, func(c *Config) *int { return &c.AuthMaxFailures })},
+	{key: "credentials.ip_ban_failures", env: "IP_BAN_FAILURES", usage: "wrong passwords before an ip is banned, default 20",
+		set: intSetting(1, 10000, func(c *Config) *int { return &c.IPBanFailures })},
+	{key: "credentials.ip_ban_duration", env: "IP_BAN_DURATION", usage: "how long an ip is banned, default 15m",
+		set: durationSetting(time.Second, func(c *Config) *time.Duration { return &c.IPBanDuration })},
+
+	{key: "features.qrcode", env: "FEATURE_QRCODE", set: boolSetting(func(c *Config) *bool { return &c.Features.QRCode })},
+	{key: "features.pending", env: "FEATURE_PENDING", set: boolSetting(func(c *Config) *bool { return &c.Features.Pending })},
+	{key: "features.provisioning", env: "FEATURE_PROVISIONING", set: boolSetting(func(c *Config) *bool { return &c.Features.Provisioning })},
+	{key: "features.jobs", env: "FEATURE_JOBS", set: boolSetting(func(c *Config) *bool { return &c.Features.Jobs })},
+	{key: "features.events", env: "FEATURE_EVENTS", set: boolSetting(func(c *Config) *bool { return &c.Features.Events })},
+	{key: "features.v1", env: "FEATURE_V1", set: boolSetting(func(c *Config) *bool { return &c.Features.V1 })},
+	{key: "features.admin", env: "FEATURE_ADMIN", set: boolSetting(func(c *Config) *bool { return &c.Features.Admin })},
+	{key: "features.metrics", env: "FEATURE_METRICS", set: boolSetting(func(c *Config) *bool { return &c.Features.Metrics })},
+}
+
+// lpacEnvPrefix 配置文件中 [lpac.env] 表的键，作为 lpac 的环境变量
+const lpacEnvPrefix = "lpac.env."
+
+func defaultConfig() *Config {
+	c := &Config{
+		SocketPort:        1888,
+		APIPort:           8008,
+		LpacTimeout:       10 * time.Minute,
+		KeepaliveTimeout:  60 * time.Second,
+		HandshakeTimeout:  10 * time.Second,
+		APIUnixSocketMode: 0o660,
+		PendingPINLength:  8,
+		MessageLang:       "en",
+		LogLevel:          slog.LevelInfo,
+		ManageIDLength:    4,
+		ManageIDCharset:   letters,
+		PasswordLength:    8,
+		PasswordCharset:   digits,
+		AuthMaxFailures:   5,
+		IPBanFailures:     20,
+		IPBanDuration:     15 * time.Minute,
+		Features: Features{
+			QRCode:       true,
+			Pending:      true,
+			Provisioning: true,
+			Jobs:         true,
+			Events:       true,
+			V1:           true,
+			Admin:        true,
+			Metrics:      true,
+		},
+	}
 	switch runtime.GOOS {
 	case "windows":
-		CFG.LpacExeName = "lpac.exe"
+		c.LpacExeName = "lpac.exe"
 	default:
-		CFG.LpacExeName = "lpac"
+		c.LpacExeName = "lpac"
+	}
+	return c
+}
+
+// ConfigSource 加载配置时使用的配置文件和命令行参数，重新加载时沿用
+type ConfigSource struct {
+	File  string
+	Flags map[string]string
+}
+
+var configSource ConfigSource
+
+// RegisterConfigFlags 注册配置对应的命令行参数，返回 flag.Parse 之后取出已设置参数的函数
+func RegisterConfigFlags(fs *flag.FlagSet) func() map[string]string {
+	values := make(map[string]*string)
+	for _, s := range settings {
+		if s.flag != "" {
+			values[s.flag] = fs.String(s.flag, "", s.usage)
+		}
+	}
+	return func() map[string]string {
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			if value, ok := values[f.Name]; ok {
+				set[f.Name] = *value
+			}
+		})
+		return set
+	}
+}
+
+// ConfigHelp 返回环境变量说明
+func ConfigHelp() string {
+	var b strings.Builder
+	for _, s := range settings {
+		if s.usage != "" {
+			fmt.Fprintf(&b, "\t%s\t%s\n", s.env, s.usage)
+		}
 	}
-	pwd, err := os.Getwd()
+	b.WriteString("\tFEATURE_*\tset to false to disable qrcode, pending, provisioning, jobs, events, v1, admin or metrics api\n")
+	return b.String()
+}
+
+func InitConfig(source ConfigSource) error {
+	c, err := LoadConfig(source)
+	if err != nil {
+		return err
+	}
+	configSource = source
+	currentConfig.Store(c)
+	SetLogLevel(c.LogLevel)
+	return nil
+}
+
+// ReloadConfig 重新读取配置，只替换可以在运行时修改的项
+func ReloadConfig() error {
+	c, err := LoadConfig(configSource)
 	if err != nil {
-		return errors.New(fmt.Sprint("Failed to get pwd: ", err))
-	}
-	CFG.LpacPath = filepath.Join(pwd, CFG.LpacExeName)
-	socketPort := strings.TrimSpace(os.Getenv("SOCKET_PORT"))
-	if socketPort == "" {
-		CFG.SocketPort = 1888
-	} else {
-		sPort, err := strconv.ParseUint(socketPort, 16, 16)
+		return err
+	}
+	old := CFG()
+	merged := *old
+	merged.AdminToken = c.AdminToken
+	merged.MetricsToken = c.MetricsToken
+	merged.ProxyTrusted = c.ProxyTrusted
+	merged.LpacFolder = c.LpacFolder
+	merged.LpacPath = c.LpacPath
+	merged.LpacEnv = c.LpacEnv
+	merged.LpacTimeout = c.LpacTimeout
+	merged.KeepaliveTimeout = c.KeepaliveTimeout
+	merged.HandshakeTimeout = c.HandshakeTimeout
+	merged.PendingPINLength = c.PendingPINLength
+	merged.MessageLang = c.MessageLang
+	merged.LogLevel = c.LogLevel
+	merged.ManageIDLength = c.ManageIDLength
+	merged.ManageIDCharset = c.ManageIDCharset
+	merged.PasswordLength = c.PasswordLength
+	merged.PasswordCharset = c.PasswordCharset
+	merged.PasswordWords = c.PasswordWords
+	merged.AuthMaxFailures = c.AuthMaxFailures
+	merged.IPBanFailures = c.IPBanFailures
+	merged.IPBanDuration = c.IPBanDuration
+	if changed := changedFields(&merged, c); len(changed) > 0 {
+		slog.Warn("Changed settings take effect after restart: " + strings.Join(changed, ", "))
+	}
+	currentConfig.Store(&merged)
+	SetLogLevel(merged.LogLevel)
+	return nil
+}
+
+// LoadConfig 依次应用默认值、配置文件、环境变量和命令行参数并检查
+func LoadConfig(source ConfigSource) (*Config, error) {
+	c := defaultConfig()
+	if source.File != "" {
+		values, err := readConfigFile(source.File)
 		if err != nil {
-			return errors.New("Failed to parse SOCKET_PORT: " + err.Error())
+			return nil, err
+		}
+		for _, s := range settings {
+			value, ok := values[s.key]
+			if !ok {
+				continue
+			}
+			delete(values, s.key)
+			if err = s.set(c, value); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", source.File, s.key, err)
+			}
+		}
+		var unknown []string
+		for key, value := range values {
+			if name, ok := strings.CutPrefix(key, lpacEnvPrefix); ok {
+				c.LpacEnv = append(c.LpacEnv, name+"="+value)
+				continue
+			}
+			unknown = append(unknown, key)
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return nil, fmt.Errorf("%s: unknown keys %s", source.File, strings.Join(unknown, ", "))
+		}
+		sort.Strings(c.LpacEnv)
+	}
+	for _, s := range settings {
+		value := strings.TrimSpace(os.Getenv(s.env))
+		if value == "" {
+			continue
+		}
+		if err := s.set(c, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+	for _, s := range settings {
+		value, ok := source.Flags[s.flag]
+		if !ok || s.flag == "" {
+			continue
+		}
+		if err := s.set(c, strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("-%s: %w", s.flag, err)
 		}
-		CFG.SocketPort = uint16(sPort)
 	}
-	apiPort := strings.TrimSpace(os.Getenv("API_PORT"))
-	if apiPort == "" {
-		CFG.APIPort = 8008
-	} else {
-		aPort, err := strconv.ParseUint(apiPort, 16, 16)
+	if err := c.finish(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// finish 计算派生的配置并检查配置之间的关系
+func (c *Config) finish() error {
+	folder := c.LpacFolder
+	if folder == "" {
+		pwd, err := os.Getwd()
 		if err != nil {
-			return errors.New("Failed to parse API_PORT: " + err.Error())
+			return errors.New(fmt.Sprint("Failed to get pwd: ", err))
 		}
-		CFG.APIPort = uint16(aPort)
+		folder = pwd
+	}
+	path, err := filepath.Abs(filepath.Join(folder, c.LpacExeName))
+	if err != nil {
+		return err
+	}
+	c.LpacPath = path
+	// 没有设置监听地址时沿用端口，保持原来的行为
+	if len(c.SocketListen) == 0 && c.SocketPort != 0 {
+		c.SocketListen = []string{fmt.Sprint("0.0.0.0:", c.SocketPort)}
+	}
+	if len(c.SocketTLSListen) == 0 && c.SocketTLSPort != 0 {
+		c.SocketTLSListen = []string{fmt.Sprint("0.0.0.0:", c.SocketTLSPort)}
+	}
+	if len(c.APIListen) == 0 {
+		c.APIListen = []string{fmt.Sprint(":", c.APIPort)}
+	}
+	if len(c.SocketListen) == 0 && len(c.SocketTLSListen) == 0 {
+		return errors.New("no rlpa socket listener, set socket.port, socket.listen or socket.tls_listen")
+	}
+	if len(c.SocketTLSListen) > 0 && (c.SocketTLSCert == "" || c.SocketTLSKey == "") {
+		return errors.New("socket.tls_cert and socket.tls_key are required for the tls rlpa socket")
+	}
+	if (c.APITLSCert == "") != (c.APITLSKey == "") {
+		return errors.New("api.tls_cert and api.tls_key must be set together")
+	}
+	if c.APITLSClientCA != "" && c.APITLSCert == "" {
+		return errors.New("api.tls_client_ca requires api.tls_cert and api.tls_key")
+	}
+	if c.PasswordWords == 1 || c.PasswordWords == 2 {
+		return errors.New("credentials.password_words must be 0 or at least 3")
 	}
 	return nil
 }
+
+// stringOnlyKeys 只接受字符串的键，TOML 的 0o660 会被解析为十进制整数 432，转换回字符串后含义改变
+var stringOnlyKeys = map[string]bool{
+	"api.unix_socket_mode": true,
+}
+
+// readConfigFile 读取 TOML 配置文件，返回 section.key 形式的值
+func readConfigFile(file string) (map[string]string, error) {
+	var raw map[string]any
+	if _, err := toml.DecodeFile(file, &raw); err != nil {
+		return nil, errors.New("Failed to read config file: " + err.Error())
+	}
+	values := make(map[string]string)
+	if err := flattenConfig("", raw, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(prefix string, raw map[string]any, values map[string]string) error {
+	for key, value := range raw {
+		switch v := value.(type) {
+		case map[string]any:
+			if err := flattenConfig(prefix+key+".", v, values); err != nil {
+				return err
+			}
+		case string:
+			values[prefix+key] = v
+		case int64, bool, float64:
+			if stringOnlyKeys[prefix+key] {
+				return fmt.Errorf("%s%s: must be a quoted string", prefix, key)
+			}
+			values[prefix+key] = fmt.Sprint(v)
+		case []any:
+			// 字符串数组按逗号连接，和环境变量的写法一致
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				str, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("%s%s: array items must be strings", prefix, key)
+				}
+				items = append(items, str)
+			}
+			values[prefix+key] = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s%s: unsupported value %v", prefix, key, value)
+		}
+	}
+	return nil
+}
+
+// changedFields 返回两份配置中不同的字段名
+func changedFields(a, b *Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+func stringSetting(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intSetting(min, max int, field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return fmt.Errorf("must be a number between %d and %d", min, max)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// portSetting 设置端口并清空优先级更低的来源中设置的监听地址
+// 同一来源中监听地址排在端口之后设置，仍然覆盖端口
+func portSetting(field func(c *Config) *uint16, listen func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return errors.New("must be a port number between 0 and 65535")
+		}
+		*field(c) = uint16(port)
+		*listen(c) = nil
+		return nil
+	}
+}
+
+func durationSetting(min time.Duration, field func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < min || d < 0 {
+			return fmt.Errorf("must be a duration like 15m, at least %s", min)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func listenSetting(allowUnix bool, field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		var addrs []string
+		for _, addr := range strings.Split(value, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			if _, _, err := parseListenAddr(addr, allowUnix); err != nil {
+				return err
+			}
+			addrs = append(addrs, addr)
+		}
+		*field(c) = addrs
+		return nil
+	}
+}
+
+func boolSetting(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// charsetSetting urlSafe 为 true 时只允许 URL 中无需转义的字符
+func charsetSetting(urlSafe bool, field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		validate := validateCharset
+		if urlSafe {
+			validate = validateURLCharset
+		}
+		if err := validate("charset", value); err != nil {
+			return err
+		}
+		*field(c) = value
+		return nil
+	}
+}
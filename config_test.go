@@ -0,0 +1,294 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rlpa-server.toml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadConfigFile(t *testing.T) {
+	file := writeConfigFile(t, `
+log_level = "warn"
+
+[socket]
+port = 1999
+listen = ["0.0.0.0:1999", "[::]:1999"]
+
+[api]
+admin_token = "secret"
+
+[features]
+qrcode = false
+
+[lpac.env]
+LPAC_APDU = "pcsc"
+`)
+	values, err := readConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"log_level":          "warn",
+		"socket.port":        "1999",
+		"socket.listen":      "0.0.0.0:1999,[::]:1999",
+		"api.admin_token":    "secret",
+		"features.qrcode":    "false",
+		"lpac.env.LPAC_APDU": "pcsc",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("readConfigFile() = %v, want %v", values, want)
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"non string array":     "[socket]\nlisten = [1888]\n",
+		"invalid toml":         "[socket\nport = 1888\n",
+		"octal integer mode":   "[api]\nunix_socket_mode = 0o660\n",
+		"decimal integer mode": "[api]\nunix_socket_mode = 660\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readConfigFile(writeConfigFile(t, content)); err == nil {
+				t.Error("readConfigFile() error = nil")
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	file := writeConfigFile(t, "[api]\nadmin_tokn = \"x\"\n")
+	_, err := LoadConfig(ConfigSource{File: file})
+	if err == nil || !strings.Contains(err.Error(), "api.admin_tokn") {
+		t.Errorf("LoadConfig() error = %v, want unknown key api.admin_tokn", err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `
+log_level = "warn"
+message_lang = "zh"
+
+[api]
+admin_token = "from-file"
+port = 9000
+
+[lpac.env]
+LPAC_APDU = "pcsc"
+`)
+	t.Setenv("LOG_LEVEL", "error")
+	t.Setenv("ADMIN_TOKEN", "from-env")
+	c, err := LoadConfig(ConfigSource{File: file, Flags: map[string]string{"log-level": "debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != slog.LevelDebug {
+		t.Errorf("LogLevel = %v, want flag value debug", c.LogLevel)
+	}
+	if c.AdminToken != "from-env" {
+		t.Errorf("AdminToken = %q, want env value", c.AdminToken)
+	}
+	if c.MessageLang != "zh" {
+		t.Errorf("MessageLang = %q, want file value zh", c.MessageLang)
+	}
+	if !reflect.DeepEqual(c.APIListen, []string{":9000"}) {
+		t.Errorf("APIListen = %v, want [:9000]", c.APIListen)
+	}
+	if !reflect.DeepEqual(c.LpacEnv, []string{"LPAC_APDU=pcsc"}) {
+		t.Errorf("LpacEnv = %v, want [LPAC_APDU=pcsc]", c.LpacEnv)
+	}
+	if c.PendingPINLength != defaultConfig().PendingPINLength {
+		t.Errorf("PendingPINLength = %d, want default", c.PendingPINLength)
+	}
+}
+
+func TestLoadConfigPortAndListen(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		flags  map[string]string
+		socket []string
+		api    []string
+	}{
+		{
+			name:   "listen overrides port in the same source",
+			file:   "[socket]\nport = 1999\nlisten = [\"127.0.0.1:1888\"]\n[api]\nport = 9000\nlisten = [\"127.0.0.1:8008\"]\n",
+			socket: []string{"127.0.0.1:1888"},
+			api:    []string{"127.0.0.1:8008"},
+		},
+		{
+			name:   "env port replaces file listen",
+			file:   "[socket]\nlisten = [\"127.0.0.1:1888\"]\n[api]\nlisten = [\"127.0.0.1:8008\"]\n",
+			env:    map[string]string{"SOCKET_PORT": "1999", "API_PORT": "9000"},
+			socket: []string{"0.0.0.0:1999"},
+			api:    []string{":9000"},
+		},
+		{
+			name:   "flag port replaces env listen",
+			env:    map[string]string{"API_LISTEN": "127.0.0.1:8008"},
+			flags:  map[string]string{"api-port": "9000"},
+			socket: []string{"0.0.0.0:1888"},
+			api:    []string{":9000"},
+		},
+		{
+			name:   "env listen overrides file port",
+			file:   "[api]\nport = 9000\n",
+			env:    map[string]string{"API_LISTEN": "unix:/run/rlpa.sock"},
+			socket: []string{"0.0.0.0:1888"},
+			api:    []string{"unix:/run/rlpa.sock"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			source := ConfigSource{Flags: tt.flags}
+			if tt.file != "" {
+				source.File = writeConfigFile(t, tt.file)
+			}
+			c, err := LoadConfig(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.SocketListen, tt.socket) {
+				t.Errorf("SocketListen = %v, want %v", c.SocketListen, tt.socket)
+			}
+			if !reflect.DeepEqual(c.APIListen, tt.api) {
+				t.Errorf("APIListen = %v, want %v", c.APIListen, tt.api)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	file := writeConfigFile(t, `
+log_level = "info"
+
+[api]
+admin_token = "old"
+port = 9000
+
+[pending]
+pin_length = 8
+`)
+	if err := InitConfig(ConfigSource{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		currentConfig.Store(defaultConfig())
+		SetLogLevel(slog.LevelInfo)
+	})
+	err := os.WriteFile(file, []byte(`
+log_level = "debug"
+
+[api]
+admin_token = "new"
+port = 9001
+
+[pending]
+pin_length = 6
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	c := CFG()
+	if c.AdminToken != "new" || c.LogLevel != slog.LevelDebug || c.PendingPINLength != 6 {
+		t.Errorf("reloadable settings not applied: token %q, log level %v, pin length %d", c.AdminToken, c.LogLevel, c.PendingPINLength)
+	}
+	// 端口需要重启才生效
+	if c.APIPort != 9000 || !reflect.DeepEqual(c.APIListen, []string{":9000"}) {
+		t.Errorf("api port changed on reload: %d %v", c.APIPort, c.APIListen)
+	}
+	// 修改长度前发出的 8 位 PIN 仍然被识别
+	if !isPendingPIN("12345678") || !isPendingPIN("123456") {
+		t.Error("PINs of the old and new length must both be accepted")
+	}
+}
+
+func TestReloadConfigInvalidKeepsCurrent(t *testing.T) {
+	file := writeConfigFile(t, "[api]\nadmin_token = \"old\"\n")
+	if err := InitConfig(ConfigSource{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { currentConfig.Store(defaultConfig()) })
+	if err := os.WriteFile(file, []byte("[api]\nadmin_token = \"new\"\nport = \"x\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfig(); err == nil {
+		t.Fatal("ReloadConfig() error = nil for an invalid port")
+	}
+	if CFG().AdminToken != "old" {
+		t.Errorf("AdminToken = %q after a failed reload, want old", CFG().AdminToken)
+	}
+}
+
+func TestLoadConfigUnixSocketMode(t *testing.T) {
+	c, err := LoadConfig(ConfigSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.APIUnixSocketMode != 0o660 {
+		t.Errorf("default APIUnixSocketMode = %o, want 660", c.APIUnixSocketMode)
+	}
+	file := writeConfigFile(t, "[api]\nunix_socket_mode = \"0640\"\n")
+	if c, err = LoadConfig(ConfigSource{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	if c.APIUnixSocketMode != 0o640 {
+		t.Errorf("APIUnixSocketMode from file = %o, want 640", c.APIUnixSocketMode)
+	}
+	t.Setenv("API_UNIX_SOCKET_MODE", "0600")
+	if c, err = LoadConfig(ConfigSource{}); err != nil {
+		t.Fatal(err)
+	}
+	if c.APIUnixSocketMode != 0o600 {
+		t.Errorf("APIUnixSocketMode = %o, want 600", c.APIUnixSocketMode)
+	}
+	for _, value := range []string{"0999", "1777", "rw"} {
+		t.Setenv("API_UNIX_SOCKET_MODE", value)
+		if _, err = LoadConfig(ConfigSource{}); err == nil {
+			t.Errorf("LoadConfig() accepted API_UNIX_SOCKET_MODE=%s", value)
+		}
+	}
+}
+
+func TestLoadConfigPINLength(t *testing.T) {
+	for value, ok := range map[string]bool{"4": false, "5": false, "6": true, "16": true, "17": false} {
+		t.Setenv("PENDING_PIN_LENGTH", value)
+		if _, err := LoadConfig(ConfigSource{}); (err == nil) != ok {
+			t.Errorf("PENDING_PIN_LENGTH=%s error = %v, want ok %v", value, err, ok)
+		}
+	}
+}
+
+func TestLoadConfigManageIDCharset(t *testing.T) {
+	for value, ok := range map[string]bool{"abcXYZ019": true, "ab-._~": true, "ab/": false, "ab?": false, "ab#": false, "ab%": false} {
+		t.Setenv("MANAGE_ID_CHARSET", value)
+		if _, err := LoadConfig(ConfigSource{}); (err == nil) != ok {
+			t.Errorf("MANAGE_ID_CHARSET=%s error = %v, want ok %v", value, err, ok)
+		}
+	}
+	// 密码放在 header 中，不限制 URL 字符
+	t.Setenv("MANAGE_ID_CHARSET", "")
+	t.Setenv("PASSWORD_CHARSET", "ab/?#%")
+	if _, err := LoadConfig(ConfigSource{}); err != nil {
+		t.Errorf("PASSWORD_CHARSET with URL reserved characters rejected: %v", err)
+	}
+}
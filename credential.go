@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// 为了避免混淆，剔除 0, O, o, 1, l, I, 2, Z, B, 8
+const letters = "abcdefghijkmnpqrstuvwxyzACDEFGHJKLMNPQRSTUVWXY345679"
+const digits = "0123456789"
+
+// passphraseWords 口令使用的单词表，256 个单词每个提供 8 bit 熵
+var passphraseWords = []string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby", "back", "ball",
+	"band", "bank", "base", "bath", "bear", "beat", "bell", "best", "bird", "blue",
+	"boat", "body", "bone", "book", "boot", "born", "both", "bowl", "busy", "cake",
+	"call", "calm", "camp", "card", "care", "cart", "case", "cash", "cave", "chef",
+	"city", "clay", "club", "coal", "coat", "code", "cold", "cook", "cool", "copy",
+	"corn", "cost", "crew", "crop", "cube", "cute", "dark", "data", "date", "dawn",
+	"deal", "deep", "deer", "desk", "dish", "dock", "door", "dove", "down", "draw",
+	"drum", "duck", "dust", "duty", "each", "earn", "east", "easy", "edge", "epic",
+	"even", "exit", "face", "fact", "fair", "fall", "farm", "fast", "fern", "file",
+	"film", "fire", "fish", "five", "flag", "flat", "flow", "foam", "fold", "folk",
+	"food", "foot", "fork", "form", "fort", "four", "free", "frog", "fuel", "full",
+	"game", "gate", "gear", "gift", "girl", "glad", "glow", "goal", "gold", "golf",
+	"good", "gray", "grid", "grow", "hair", "half", "hall", "hand", "harp", "hawk",
+	"head", "heat", "help", "herb", "hero", "high", "hill", "home", "hook", "hope",
+	"horn", "host", "hour", "huge", "idea", "inch", "iron", "item", "jazz", "join",
+	"joke", "jump", "jury", "keen", "kept", "kick", "kind", "king", "kite", "knee",
+	"knot", "lake", "lamp", "land", "lane", "last", "lawn", "leaf", "left", "lens",
+	"life", "lift", "lime", "line", "lion", "list", "loaf", "lock", "loft", "long",
+	"loud", "love", "luck", "lump", "mail", "main", "mall", "many", "maple", "mask",
+	"meal", "mild", "milk", "mind", "mint", "mist", "mode", "moon", "more", "moss",
+	"most", "moth", "move", "much", "nail", "name", "navy", "near", "neat", "neck",
+	"nest", "news", "next", "nice", "nine", "noon", "nose", "note", "oak", "oath",
+	"open", "oval", "oven", "pace", "page", "palm", "park", "path", "peak", "pear",
+	"pine", "pink", "plan", "play", "plum", "poem", "pond", "pool", "port", "push",
+	"quiz", "race", "rain", "ramp", "rest", "rice", "rich", "ride", "ring", "road",
+	"rock", "roof", "room", "root", "rope", "rose",
+}
+
+// generateID 按配置生成 ManageID
+func generateID() (string, error) {
+	return randomString(CFG().ManageIDCharset, CFG().ManageIDLength)
+}
+
+// generatePasswd 按配置生成密码，PASSWORD_WORDS 大于 0 时生成单词口令
+func generatePasswd() (string, error) {
+	if CFG().PasswordWords > 0 {
+		return generatePassphrase(CFG().PasswordWords)
+	}
+	return randomString(CFG().PasswordCharset, CFG().PasswordLength)
+}
+
+// generatePassphrase 生成 n 个以 - 连接的单词
+func generatePassphrase(n int) (string, error) {
+	words := make([]string, n)
+	max := big.NewInt(int64(len(passphraseWords)))
+	for i := range words {
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		words[i] = passphraseWords[index.Int64()]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+// credentialHash 加盐的密码哈希，内存中不保存明文密码
+type credentialHash struct {
+	salt [16]byte
+	sum  [sha256.Size]byte
+}
+
+func hashCredential(passwd string) (credentialHash, error) {
+	var h credentialHash
+	if _, err := rand.Read(h.salt[:]); err != nil {
+		return h, errors.New("failed to generate salt: " + err.Error())
+	}
+	h.sum = h.digest(passwd)
+	return h, nil
+}
+
+func (h *credentialHash) digest(passwd string) [sha256.Size]byte {
+	return sha256.Sum256(append(h.salt[:], passwd...))
+}
+
+// Verify 以固定时间比较密码
+func (h *credentialHash) Verify(passwd string) bool {
+	sum := h.digest(passwd)
+	return subtle.ConstantTimeCompare(sum[:], h.sum[:]) == 1
+}
+
+// validateURLCharset 检查字符集只包含 URL 中无需转义的字符，ManageID 会作为路径的一段
+func validateURLCharset(name, charset string) error {
+	if err := validateCharset(name, charset); err != nil {
+		return err
+	}
+	for _, r := range charset {
+		unreserved := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~", r)
+		if !unreserved {
+			return errors.New(name + " must only contain letters, digits and -._~, found " + string(r))
+		}
+	}
+	return nil
+}
+
+// validateCharset 检查字符集可用于生成凭据
+func validateCharset(name, charset string) error {
+	if len(charset) < 2 {
+		return errors.New(name + " must contain at least 2 characters")
+	}
+	seen := make(map[rune]bool)
+	for _, r := range charset {
+		if r <= ' ' || r > '~' {
+			return errors.New(name + " must only contain printable ASCII characters")
+		}
+		if seen[r] {
+			return errors.New(name + " contains duplicate character " + string(r))
+		}
+		seen[r] = true
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventLifecycle  = "lifecycle"
+	EventProgress   = "progress"
+	EventAPDU       = "apdu"
+	EventMessageBox = "messagebox"
+	EventResult     = "result"
+
+	eventBufferSize = 64
+)
+
+type SessionEvent struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type LifecycleEvent struct {
+	State    string   `json:"state"`
+	WorkMode string   `json:"work_mode,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Result   *int     `json:"result,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+type APDUEvent struct {
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+type MessageBoxEvent struct {
+	Text string `json:"text"`
+}
+
+// EventHub 将会话事件分发给 API 订阅者，订阅者读取过慢时丢弃事件而不阻塞 lpac
+type EventHub struct {
+	mu          sync.Mutex
+	closed      bool
+	subscribers map[chan SessionEvent]struct{}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan SessionEvent]struct{})}
+}
+
+// Subscribe 返回事件通道，会话关闭时通道被关闭
+func (h *EventHub) Subscribe() chan SessionEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan SessionEvent, eventBufferSize)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *EventHub) Unsubscribe(ch chan SessionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, exists := h.subscribers[ch]; exists {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *EventHub) Publish(eventType string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event := SessionEvent{Type: eventType, Time: time.Now(), Data: data}
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
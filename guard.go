@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	authBackoffBase = time.Second
+	authBackoffMax  = 5 * time.Minute
+	// ipv6GuardBits IPv6 按 /64 记录失败和封禁，一个用户通常持有整个 /64，可以随意更换地址
+	ipv6GuardBits = 64
+)
+
+var ErrIPBanned = errors.New("ip is banned")
+
+// authRecord 一个 IP 或 ManageID 的连续失败记录
+type authRecord struct {
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
+
+// Ban 被封禁的 IP
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Failures  int       `json:"failures,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Until     time.Time `json:"until"`
+}
+
+// Backoff 正在退避中的 IP 或 ManageID
+type Backoff struct {
+	Key      string    `json:"key"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+type GuardStatus struct {
+	Bans      []Ban     `json:"bans"`
+	IPs       []Backoff `json:"ips"`
+	ManageIDs []Backoff `json:"manage_ids"`
+}
+
+// AuthGuard 记录管理 API 的密码错误，按 IP 和 ManageID 指数退避，IP 失败过多时封禁
+type AuthGuard struct {
+	mu   sync.Mutex
+	ips  map[string]*authRecord
+	ids  map[string]*authRecord
+	bans map[string]Ban
+}
+
+var Guard = NewAuthGuard()
+
+func NewAuthGuard() *AuthGuard {
+	return &AuthGuard{
+		ips:  make(map[string]*authRecord),
+		ids:  make(map[string]*authRecord),
+		bans: make(map[string]Ban),
+	}
+}
+
+// Check 返回需要等待的时间，IP 被封禁时返回 ErrIPBanned，ip 为空时只检查 ManageID
+func (g *AuthGuard) Check(ip, id string) (time.Duration, error) {
+	ip = guardKey(ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if ban, ok := g.bans[ip]; ok && ip != "" {
+		if now.Before(ban.Until) {
+			return ban.Until.Sub(now), ErrIPBanned
+		}
+		delete(g.bans, ip)
+	}
+	var wait time.Duration
+	for _, record := range []*authRecord{g.ips[ip], g.ids[id]} {
+		if record != nil && now.Before(record.BlockedUntil) {
+			wait = max(wait, record.BlockedUntil.Sub(now))
+		}
+	}
+	return wait, nil
+}
+
+// Failure 记录一次失败，返回 ManageID 是否达到失败上限，id 为空时只记录 IP，ip 为空时只记录 ManageID
+func (g *AuthGuard) Failure(ip, id string) bool {
+	ip = guardKey(ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.removeExpired(now)
+	if ip != "" {
+		g.failIP(ip, now)
+	}
+	// 管理员 token 错误时没有 ManageID
+	if id == "" {
+		return false
+	}
+	if g.fail(g.ids, id, now).Failures >= CFG().AuthMaxFailures {
+		delete(g.ids, id)
+		return true
+	}
+	return false
+}
+
+// failIP 记录 IP 的失败，达到上限时封禁
+func (g *AuthGuard) failIP(ip string, now time.Time) {
+	ipRecord := g.fail(g.ips, ip, now)
+	if ipRecord.Failures >= CFG().IPBanFailures {
+		g.bans[ip] = Ban{
+			IP:        ip,
+			Reason:    "too many failed logins",
+			Failures:  ipRecord.Failures,
+			CreatedAt: now,
+			Until:     now.Add(CFG().IPBanDuration),
+		}
+		delete(g.ips, ip)
+		slog.Warn("Banned ip", "ip", ip, "failures", ipRecord.Failures, "until", now.Add(CFG().IPBanDuration))
+	}
+}
+
+// Success 登录成功后清除该 ManageID 的记录，IP 的记录保留到过期，避免用自己的会话重置计数
+func (g *AuthGuard) Success(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.ids, id)
+}
+
+// Ban 手动封禁 IP，IPv6 封禁所在的 /64
+func (g *AuthGuard) Ban(ip, reason string, d time.Duration) Ban {
+	ip = guardKey(ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	ban := Ban{IP: ip, Reason: reason, CreatedAt: now, Until: now.Add(d)}
+	g.bans[ip] = ban
+	return ban
+}
+
+// Unban 解除封禁，IP 未被封禁时返回 false
+func (g *AuthGuard) Unban(ip string) bool {
+	ip = guardKey(ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.bans[ip]
+	delete(g.bans, ip)
+	delete(g.ips, ip)
+	return ok
+}
+
+// Banned IP 当前是否被封禁
+func (g *AuthGuard) Banned(ip string) bool {
+	ip = guardKey(ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ban, ok := g.bans[ip]
+	return ok && time.Now().Before(ban.Until)
+}
+
+// Status 返回当前的封禁和退避状态
+func (g *AuthGuard) Status() GuardStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.removeExpired(now)
+	status := GuardStatus{
+		Bans:      make([]Ban, 0, len(g.bans)),
+		IPs:       backoffList(g.ips),
+		ManageIDs: backoffList(g.ids),
+	}
+	for _, ban := range g.bans {
+		status.Bans = append(status.Bans, ban)
+	}
+	sort.Slice(status.Bans, func(i, j int) bool {
+		return status.Bans[i].CreatedAt.Before(status.Bans[j].CreatedAt)
+	})
+	return status
+}
+
+func (g *AuthGuard) fail(records map[string]*authRecord, key string, now time.Time) *authRecord {
+	record, ok := records[key]
+	if !ok {
+		record = new(authRecord)
+		records[key] = record
+	}
+	record.Failures++
+	record.LastFailure = now
+	record.BlockedUntil = now.Add(authBackoff(record.Failures))
+	return record
+}
+
+// removeExpired 清理超过封禁时长没有新失败的记录和到期的封禁
+func (g *AuthGuard) removeExpired(now time.Time) {
+	for _, records := range []map[string]*authRecord{g.ips, g.ids} {
+		for key, record := range records {
+			if now.Sub(record.LastFailure) > CFG().IPBanDuration {
+				delete(records, key)
+			}
+		}
+	}
+	for ip, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, ip)
+		}
+	}
+}
+
+// authBackoff 第 n 次失败后的等待时间，从 1 秒开始每次翻倍
+func authBackoff(failures int) time.Duration {
+	if failures > 16 {
+		return authBackoffMax
+	}
+	return min(authBackoffBase<<(failures-1), authBackoffMax)
+}
+
+func backoffList(records map[string]*authRecord) []Backoff {
+	list := make([]Backoff, 0, len(records))
+	for key, record := range records {
+		list = append(list, Backoff{Key: key, Failures: record.Failures, Until: record.BlockedUntil})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// guardKey 返回记录失败和封禁使用的键，IPv4 为地址本身，IPv6 为所在的 /64
+// 也接受 CIDR 写法，无法解析时原样返回
+func guardKey(ip string) string {
+	if prefix, err := netip.ParsePrefix(ip); err == nil {
+		ip = prefix.Addr().String()
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is4() {
+		return addr.String()
+	}
+	return netip.PrefixFrom(addr, ipv6GuardBits).Masked().String()
+}
+
+// guardKeyOf 连接地址对应的失败和封禁记录的键
+func guardKeyOf(addr net.Addr) string {
+	return guardKey(hostOf(addr))
+}
+
+// requestIP 返回请求来源 IP，Unix socket 的对端没有 IP，返回空字符串，不计入 IP 的退避和封禁
+func requestIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return ""
+	}
+	return splitHost(r.RemoteAddr)
+}
+
+// hostOf 返回连接地址中的 IP
+func hostOf(addr net.Addr) string {
+	return splitHost(addr.String())
+}
+
+func splitHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
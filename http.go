@@ -1,24 +1,102 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	maxQRCodeImageSize   = 5 << 20
+	sseKeepaliveInterval = 15 * time.Second
 )
 
 func HttpServer() {
-	http.HandleFunc("/", homeHandler)
+	http.HandleFunc("/{$}", homeHandler)
 	http.HandleFunc("/manifest", manifestHandler)
 	http.HandleFunc("/info/{id}", infoHandler)
 	http.HandleFunc("/connect/{id}", connectHandler)
 	http.HandleFunc("/disconnect/{id}", disconnectHandler)
 	http.HandleFunc("/shell/{id}", shellHandler)
 	http.HandleFunc("/keepalive/{id}", keepaliveHandler)
+	features := CFG().Features
+	if features.Events {
+		http.HandleFunc("GET /progress/{id}", progressHandler)
+		http.HandleFunc("GET /events/{id}", eventsHandler)
+	}
+	if features.Jobs {
+		http.HandleFunc("POST /jobs/{id}", jobSubmitHandler)
+		http.HandleFunc("GET /jobs/{id}/{job}", jobGetHandler)
+		http.HandleFunc("DELETE /jobs/{id}/{job}", jobCancelHandler)
+	}
+	if features.Pending {
+		http.HandleFunc("POST /confirmcode", confirmCodeHandler)
+		http.HandleFunc("POST /pending", pendingHandler)
+	}
+	if features.QRCode {
+		http.HandleFunc("POST /qrcode/{id}", qrcodeHandler)
+	}
+	if features.Provisioning {
+		http.HandleFunc("GET /provision/{eid}", provisionListHandler)
+		http.HandleFunc("POST /provision/{eid}", provisionAddHandler)
+		http.HandleFunc("DELETE /provision/{eid}/{op}", provisionDeleteHandler)
+	}
+	if features.Metrics {
+		http.HandleFunc("GET /metrics", metricsHandler)
+	}
+	if features.Admin {
+		registerAdminHandlers()
+	}
+	if features.V1 {
+		registerV1Handlers()
+	}
+
+	server := &http.Server{}
+	useTLS := CFG().APITLSCert != ""
+	scheme := "http://"
+	if useTLS {
+		reloader, err := NewCertReloader(CFG().APITLSCert, CFG().APITLSKey, CFG().APITLSClientCA)
+		if err != nil {
+			panic(err)
+		}
+		OnReload("api certificate", reloader.Reload)
+		// 客户端证书是可选的，只有管理接口要求证书
+		server.TLSConfig = reloader.TLSConfig(tls.VerifyClientCertIfGiven)
+		scheme = "https://"
+	}
+	var listeners []net.Listener
+	for _, addr := range CFG().APIListen {
+		listener, err := listen(addr)
+		if err != nil {
+			panic(err)
+		}
+		slog.Info("Start API server on " + scheme + addr)
+		listeners = append(listeners, listener)
+	}
+	for _, listener := range listeners[1:] {
+		go serveAPI(server, listener, useTLS)
+	}
+	serveAPI(server, listeners[0], useTLS)
+}
 
-	slog.Info(fmt.Sprint("Start API server on port ", CFG.APIPort))
-	err := http.ListenAndServe(fmt.Sprint(":", CFG.APIPort), nil)
+// serveAPI 在一个监听地址上提供 API，多个地址共用同一个 server
+func serveAPI(server *http.Server, listener net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -34,127 +112,700 @@ func manifestHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "manifest\n")
 }
 
+// infoHandler 返回会话信息，EID 和配置文件列表来自缓存
+// 携带 Lease 头时，refresh=1 或没有缓存时通过 lpac 读取，否则只返回缓存，其他客户端持有租约时也可以查看状态
 func infoHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO
-	id := r.PathValue("id")
-	if verify(id, r.Header.Get("Password")) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, fmt.Sprint("hello ", id))
-	} else {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "Unauthorized")
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get(leaseHeader) != "" {
+		refresh := r.URL.Query().Get("refresh") == "1"
+		chipInfo, profiles := c.CachedChip()
+		if refresh || chipInfo == nil {
+			if _, ok = runLpacCommand(w, r, c, "chip", "info"); !ok {
+				return
+			}
+		}
+		if refresh || profiles == nil {
+			if _, ok = runLpacCommand(w, r, c, "profile", "list"); !ok {
+				return
+			}
+		}
+	}
+	chipInfo, profiles := c.CachedChip()
+	held, expires := c.LeaseInfo()
+	info := SessionInfo{
+		ID:          c.ID(),
+		RemoteAddr:  c.RemoteAddr(),
+		ConnectedAt: c.ConnectedAt,
+		WorkMode:    WorkModeName(c.WorkMode()),
+		Role:        c.Role(),
+		APILocked:   held,
+	}
+	// 没有读取过时为 null，和空列表区分
+	if profiles != nil {
+		info.Profiles = NewProfiles(profiles)
 	}
+	if held {
+		info.KeepAliveExpires = &expires
+	}
+	if proc := c.Lpac(); proc != nil && proc.Running() {
+		info.LpacRunning = true
+		info.LpacArgs = proc.Args
+	}
+	if chipInfo != nil {
+		info.EID = chipInfo.EID
+	}
+	writeJSON(w, http.StatusOK, info)
 }
 
+// connectHandler 获取 API 租约，之后的 shell 和 keepalive 请求需要在 Lease 头中携带 token
 func connectHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO
-	id := r.PathValue("id")
-	passwd := r.Header.Get("Password")
-	if verify(id, passwd) {
-		c, err := FindClient(id)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "rlpa client disconnected")
-			return
-		}
-		if c.APILocked {
-			w.WriteHeader(http.StatusConflict)
-			return
-		}
-		c.APILocked = true
-		c.StartOrResetTimer()
-		w.WriteHeader(http.StatusOK)
+	c, ok := authClient(w, r)
+	if !ok {
 		return
-	} else {
-		w.WriteHeader(http.StatusUnauthorized)
+	}
+	token, expires, err := c.AcquireLease()
+	if err != nil {
+		writeLeaseError(w, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, LeaseResponse{Lease: token, ExpiresAt: expires})
 }
 
 func disconnectHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO 释放连接
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	if err := c.ReleaseLease(r.Header.Get(leaseHeader)); err != nil {
+		writeLeaseError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 func keepaliveHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO
-	id := r.PathValue("id")
-	passwd := r.Header.Get("Password")
-	if verify(id, passwd) {
-		c, err := FindClient(id)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "rlpa client disconnected")
-			return
-		}
-		if !c.APILocked || c.KeepAliveTimer == nil {
-			w.WriteHeader(http.StatusTeapot)
-			return
-		}
-		c.StartOrResetTimer()
+	c, ok := authClient(w, r)
+	if !ok {
 		return
-	} else {
-		w.WriteHeader(http.StatusUnauthorized)
+	}
+	token := r.Header.Get(leaseHeader)
+	expires, err := c.RenewLease(token)
+	if err != nil {
+		writeLeaseError(w, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, LeaseResponse{Lease: token, ExpiresAt: expires})
 }
 
 func shellHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO 执行 shell
-	id := r.PathValue("id")
-	passwd := r.Header.Get("Password")
-	if verify(id, passwd) {
-		c, err := FindClient(id)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "rlpa client disconnected")
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	lease, ok := requireLease(w, r, c)
+	if !ok {
+		return
+	}
+	// decode json body
+	var payload ShellRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	switch payload.Type {
+	case TypeFinish:
+		c.Close(ResultFinished)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Closed")
+		return
+	case TypeExecute:
+		args, errArgs := shellArgs(payload)
+		if errArgs != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", errArgs.Error())
 			return
 		}
-		// decode json body
-		var payload ShellRequest
-		err = json.NewDecoder(r.Body).Decode(&payload)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "bad request")
+		if !authorizeCommand(w, r, c, args) {
 			return
 		}
-		switch payload.Type {
-		case TypeFinish:
-			c.Close(ResultFinished)
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "Closed")
+		c.DebugLog(fmt.Sprintf("command %q", args))
+		job, ok := runJob(w, r, c, lease, args)
+		if !ok {
+			return
+		}
+		if job.Stdout == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "%s", job.Error)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(job.Stdout)
+		return
+	}
+}
+
+// eventStream 会话事件流的输出方式，/progress 是 /events 的过滤视图
+type eventStream struct {
+	types       map[string]bool // 为空时输出全部事件
+	ndjson      bool            // 按行输出 JSON，否则为 Server-Sent Events
+	untilResult bool            // 收到 result 事件后结束
+}
+
+// parseEventTypes 解析逗号分隔的事件类型
+func parseEventTypes(value string) map[string]bool {
+	types := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			types[name] = true
+		}
+	}
+	return types
+}
+
+// progressHandler 以 NDJSON 流的形式输出下一次 lpac 运行的进度，收到结果后结束
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, eventStream{
+		types:       map[string]bool{EventProgress: true, EventResult: true},
+		ndjson:      true,
+		untilResult: true,
+	})
+}
+
+// eventsHandler 以 Server-Sent Events 输出会话的事件，直到会话关闭，type 参数可以只订阅部分类型
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, eventStream{types: parseEventTypes(r.URL.Query().Get("type"))})
+}
+
+func streamEvents(w http.ResponseWriter, r *http.Request, stream eventStream) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "streaming unsupported")
+		return
+	}
+	events := c.Events.Subscribe()
+	defer c.Events.Unsubscribe(events)
+	if stream.ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	writeEvent := func(event SessionEvent) bool {
+		if len(stream.types) > 0 && !stream.types[event.Type] {
+			return true
+		}
+		data, errMarshal := json.Marshal(event)
+		if errMarshal != nil {
+			return false
+		}
+		var errWrite error
+		if stream.ndjson {
+			_, errWrite = fmt.Fprintf(w, "%s\n", data)
+		} else {
+			_, errWrite = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+		return errWrite == nil
+	}
+	// 订阅后先发送当前状态
+	writeEvent(SessionEvent{
+		Type: EventLifecycle,
+		Time: time.Now(),
+		Data: LifecycleEvent{State: "subscribed", WorkMode: WorkModeName(c.WorkMode())},
+	})
+	// NDJSON 没有注释行，只有 SSE 发送心跳
+	var keepalive <-chan time.Time
+	if !stream.ndjson {
+		ticker := time.NewTicker(sseKeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
 			return
-		case TypeExecute:
-			if c.ResponseWaiting {
-				w.WriteHeader(http.StatusConflict)
-				fmt.Fprintf(w, "already has one lpac shell running")
+		case <-keepalive:
+			if _, errWrite := fmt.Fprint(w, ": ping\n\n"); errWrite != nil {
 				return
 			}
-			c.DebugLog("command " + payload.Command)
-			err = c.processOpenLpac(strings.Split(strings.TrimSpace(payload.Command), " ")...)
-			if err != nil {
-				w.WriteHeader(http.StatusBadGateway)
-				fmt.Fprintf(w, "failed to open lpac")
+			flusher.Flush()
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			if !writeEvent(event) {
+				return
+			}
+			if stream.untilResult && event.Type == EventResult {
 				return
 			}
-			c.ResponseWaiting = true
-			resp := <-c.ResponseChan
-			c.ResponseWaiting = false
-			fmt.Fprintf(w, string(resp))
-			return
 		}
+	}
+}
 
-	} else {
+func confirmCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifyAdmin(r) {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprintf(w, "Unauthorized")
+		return
+	}
+	var payload ConfirmCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	payload.MatchingID = strings.TrimSpace(payload.MatchingID)
+	payload.ConfirmationCode = strings.TrimSpace(payload.ConfirmationCode)
+	if payload.MatchingID == "" || payload.ConfirmationCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "matching_id and confirmation_code are required")
+		return
+	}
+	entry, err := Pending.RegisterConfirmCode(payload.MatchingID, payload.ConfirmationCode, pendingTTL(payload.TTL))
+	if errors.Is(err, ErrPendingStoreFull) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("pending store: " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to register confirmation code")
+		return
 	}
+	slog.Info("Registered pending confirm code", "matching_id", payload.MatchingID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ConfirmCodeResponse{ExpiresAt: entry.ExpiresAt})
 }
 
-func verify(id, passwd string) bool {
-	if v, exists := Credentials[id]; exists {
-		if passwd == v {
-			return true
+// pendingTTL 请求中的有效期，单位秒，未设置时使用默认值
+func pendingTTL(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultPendingTTL
+	}
+	return min(time.Duration(seconds)*time.Second, maxPendingTTL)
+}
+
+func pendingHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifyAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorized")
+		return
+	}
+	var payload PendingRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	code, _ := CompleteActivationCode(payload.ActivationCode)
+	ac, err := ParseActivationCode(code)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	payload.ConfirmationCode = strings.TrimSpace(payload.ConfirmationCode)
+	if ac.ConfirmCodeRequired && payload.ConfirmationCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "confirmation code required")
+		return
+	}
+	entry, err := Pending.Register(ac.String(), payload.ConfirmationCode, pendingTTL(payload.TTL))
+	if errors.Is(err, ErrPendingStoreFull) || errors.Is(err, ErrPINExhausted) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("pending store: " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to register pending download")
+		return
+	}
+	slog.Info("Registered pending download", "smdp", ac.SMDP, "expires", entry.ExpiresAt)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(PendingResponse{
+		PIN:       entry.PIN,
+		ExpiresAt: entry.ExpiresAt,
+	})
+}
+
+func qrcodeHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	// 解码图片开销较大，先确认持有租约
+	lease, ok := requireLease(w, r, c)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxQRCodeImageSize)
+	// 支持直接 POST 图片或 multipart 表单的 image 字段
+	var img io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, errForm := r.FormFile("image")
+		if errForm != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "missing image field")
+			return
 		}
+		defer file.Close()
+		img = file
+	}
+	text, err := DecodeQRCode(img)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	code, steps := CompleteActivationCode(text)
+	if len(steps) > 0 {
+		c.DebugLog("activation code normalized (" + strings.Join(steps, ", ") + "): " + code)
+	}
+	pullInfo, confirmCodeNeeded, err := DecodeLpaActivationCode(code)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	pullInfo.ConfirmCode = strings.TrimSpace(r.FormValue("confirmation_code"))
+	if confirmCodeNeeded && pullInfo.ConfirmCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "confirmation code required")
+		return
+	}
+	args := downloadArgs(pullInfo)
+	if !authorizeCommand(w, r, c, args) {
+		return
+	}
+	c.InfoLog("Download profile from QR code: " + code)
+	job, ok := runJob(w, r, c, lease, args)
+	if !ok {
+		return
+	}
+	if job.Stdout == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "%s", job.Error)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(QRCodeResponse{
+		ActivationCode: code,
+		Result:         job.Stdout,
+	})
+}
+
+func jobSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	var payload ShellRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	args, err := shellArgs(payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if _, ok = requireLease(w, r, c); !ok {
+		return
+	}
+	if !authorizeCommand(w, r, c, args) {
+		return
+	}
+	job, err := c.Jobs.Submit(args)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	c.DebugLog(fmt.Sprintf("queued job %s command %q", job.ID, args))
+	snapshot, _ := c.Jobs.Get(job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(snapshot)
+}
+
+func jobGetHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	job, exists := c.Jobs.Get(r.PathValue("job"))
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func jobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = requireLease(w, r, c); !ok {
+		return
+	}
+	job, exists := c.Jobs.Cancel(r.PathValue("job"))
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "job not found")
+		return
+	}
+	c.InfoLog("Canceled job " + job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func provisionListHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifyAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorized")
+		return
+	}
+	eid, err := NormalizeEID(r.PathValue("eid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Provisioning.List(eid))
+}
+
+func provisionAddHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifyAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorized")
+		return
+	}
+	eid, err := NormalizeEID(r.PathValue("eid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	var op ProvisionOperation
+	err = json.NewDecoder(r.Body).Decode(&op)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	op, err = Provisioning.Enqueue(eid, op)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	slog.Info("Queued provision operation", "eid", eid, "type", op.Type, "id", op.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(op)
+}
+
+func provisionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifyAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorized")
+		return
+	}
+	eid, err := NormalizeEID(r.PathValue("eid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	if !Provisioning.Remove(eid, r.PathValue("op")) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "operation not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyAdmin 校验 Authorization: Bearer {ADMIN_TOKEN}，未配置 token 时一律拒绝
+func verifyAdmin(r *http.Request) bool {
+	if CFG().AdminToken == "" {
 		return false
 	}
+	ip := requestIP(r)
+	if Guard.Banned(ip) {
+		return false
+	}
+	valid, wrongToken := checkAdminToken(r)
+	if wrongToken {
+		// 错误的 token 计入 IP 的失败次数
+		Guard.Failure(ip, "")
+	}
+	return valid
+}
+
+// checkAdminToken 检查管理员 token 和客户端证书，不记录失败，wrongToken 表示携带了错误的 token
+func checkAdminToken(r *http.Request) (valid bool, wrongToken bool) {
+	if CFG().AdminToken == "" {
+		return false, false
+	}
+	// 配置了客户端 CA 时，管理接口要求由该 CA 签发的客户端证书
+	if CFG().APITLSClientCA != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false, false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(CFG().AdminToken)) != 1 {
+		return false, true
+	}
+	return true, false
+}
+
+// shellArgs 从请求中取出 lpac 参数，args 优先，command 按 shell 规则拆分
+func shellArgs(payload ShellRequest) ([]string, error) {
+	if len(payload.Args) > 0 {
+		if strings.TrimSpace(payload.Command) != "" {
+			return nil, errors.New("use either command or args, not both")
+		}
+		return payload.Args, nil
+	}
+	args, err := SplitCommand(payload.Command)
+	if err != nil {
+		return nil, errors.New("cannot parse command: " + err.Error())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// authorizeCommand 按照命令策略检查会话角色，携带有效的管理员 token 时使用 admin 角色
+// 只在携带 Authorization 时检查 token，错误的 token 计入 IP 的失败次数
+func authorizeCommand(w http.ResponseWriter, r *http.Request, c *RLPAClient, args []string) bool {
+	role := c.Role()
+	if r.Header.Get("Authorization") != "" {
+		valid, wrongToken := checkAdminToken(r)
+		if valid {
+			role = RoleAdmin
+		}
+		if wrongToken {
+			Guard.Failure(requestIP(r), "")
+		}
+	}
+	decision := CommandPolicy.Check(role, args, r.Header.Get(confirmHeader))
+	if decision.Allowed {
+		return true
+	}
+	slog.Warn("Denied command", "client", c.RemoteAddr(), "command", decision.Command, "role", role, "reason", decision.Reason, "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(decision)
 	return false
 }
+
+// runJob 排队执行 lpac 命令并等待结束，请求被取消或租约结束时同时取消任务
+func runJob(w http.ResponseWriter, r *http.Request, c *RLPAClient, lease *APILease, args []string) (Job, bool) {
+	job, err := c.Jobs.Submit(args)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err.Error())
+		return Job{}, false
+	}
+	select {
+	case <-job.Done():
+	case <-r.Context().Done():
+		c.Jobs.Cancel(job.ID)
+		return Job{}, false
+	case <-leaseDone(lease):
+		c.Jobs.Cancel(job.ID)
+		writeLeaseEnded(w, lease)
+		return Job{}, false
+	}
+	result, _ := c.Jobs.Get(job.ID)
+	return result, true
+}
+
+// authClient 校验 ManageID 和密码并查找对应的连接，失败时写入响应
+func authClient(w http.ResponseWriter, r *http.Request) (*RLPAClient, bool) {
+	id := r.PathValue("id")
+	ip := requestIP(r)
+	wait, err := Guard.Check(ip, id)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err.Error())
+		return nil, false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "too many failed attempts, retry later")
+		return nil, false
+	}
+	if !verify(id, r.Header.Get("Password")) {
+		slog.Debug("Wrong password", "ip", ip, "id", id)
+		if Guard.Failure(ip, id) {
+			revokeCredential(id)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorized")
+		return nil, false
+	}
+	Guard.Success(id)
+	c, found := Sessions.Find(id)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "rlpa client disconnected")
+		return nil, false
+	}
+	return c, true
+}
+
+// revokeCredential 密码错误次数过多时作废凭据，并在设备上显示新的凭据
+func revokeCredential(id string) {
+	c, ok := Sessions.Find(id)
+	if !ok {
+		return
+	}
+	passwd, err := Sessions.Rotate(c)
+	if err != nil {
+		c.ErrLog("Failed to generate credential: " + err.Error())
+		c.Close(ResultError)
+		return
+	}
+	slog.Warn("Too many wrong passwords, credential replaced", "client", c.RemoteAddr(), "id", id)
+	err = c.MessageBox(fmt.Sprintf("Too many wrong passwords, someone may be guessing\nNew ManageID: %s\nPassword: %s", c.ID(), passwd))
+	if err != nil {
+		c.ErrLog(err.Error())
+	}
+}
+
+func verify(id, passwd string) bool {
+	return Sessions.Verify(id, passwd)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessageBoxSize 管理员推送的消息长度上限
+const maxMessageBoxSize = 1024
+
+func registerAdminHandlers() {
+	http.HandleFunc("GET /admin/sessions", adminSessionsHandler)
+	http.HandleFunc("DELETE /admin/sessions/{serial}", adminKillHandler)
+	http.HandleFunc("POST /admin/sessions/{serial}/messagebox", adminMessageBoxHandler)
+	http.HandleFunc("GET /admin/bans", adminBansHandler)
+	http.HandleFunc("POST /admin/bans", adminBanHandler)
+	http.HandleFunc("DELETE /admin/bans/{ip}", adminUnbanHandler)
+	http.HandleFunc("GET /admin/loglevel", adminLogLevelHandler)
+	http.HandleFunc("PUT /admin/loglevel", adminSetLogLevelHandler)
+}
+
+// requireAdmin 校验管理员 token，失败时写入响应
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !verifyAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// adminClient 按路径中的连接序号查找连接，失败时写入响应
+func adminClient(w http.ResponseWriter, r *http.Request) (*RLPAClient, bool) {
+	serial, err := strconv.ParseUint(r.PathValue("serial"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid session serial")
+		return nil, false
+	}
+	c, ok := Sessions.Get(serial)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "rlpa client disconnected")
+		return nil, false
+	}
+	return c, true
+}
+
+func adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	clients := Sessions.Snapshot()
+	sessions := make([]AdminSession, 0, len(clients))
+	for _, c := range clients {
+		sessions = append(sessions, NewAdminSession(c))
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func adminKillHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	c, ok := adminClient(w, r)
+	if !ok {
+		return
+	}
+	slog.Warn("Session killed by admin", "client", c.RemoteAddr(), "ip", requestIP(r))
+	c.Close(ResultError)
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminMessageBoxHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	c, ok := adminClient(w, r)
+	if !ok {
+		return
+	}
+	var payload MessageBoxRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	if strings.TrimSpace(payload.Text) == "" || len(payload.Text) > maxMessageBoxSize {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "text must be 1 to %d bytes", maxMessageBoxSize)
+		return
+	}
+	if err := c.MessageBox(payload.Text); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminBansHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, Guard.Status())
+}
+
+// adminBanHandler 封禁 IP 并断开该 IP 现有的 RLPA 连接
+func adminBanHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var payload BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	ip := net.ParseIP(strings.TrimSpace(payload.IP))
+	if ip == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid ip")
+		return
+	}
+	duration := CFG().IPBanDuration
+	if payload.Duration != "" {
+		d, err := time.ParseDuration(payload.Duration)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid duration")
+			return
+		}
+		duration = d
+	}
+	ban := Guard.Ban(ip.String(), orDefault(payload.Reason, "banned by admin"), duration)
+	slog.Warn("Banned ip by admin", "ip", ban.IP, "until", ban.Until)
+	for _, c := range Sessions.Snapshot() {
+		// IPv6 的封禁覆盖整个 /64，按同样的键比较
+		if guardKeyOf(c.Socket.RemoteAddr()) == ban.IP {
+			c.Close(ResultError)
+		}
+	}
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func adminUnbanHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !Guard.Unban(r.PathValue("ip")) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "ip not banned")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, LogLevelRequest{Level: strings.ToLower(logLevel.Level().String())})
+}
+
+func adminSetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var payload LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(payload.Level)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "level must be debug, info, warn or error")
+		return
+	}
+	SetLogLevel(level)
+	slog.Info("Log level set to " + level.String())
+	writeJSON(w, http.StatusOK, LogLevelRequest{Level: strings.ToLower(level.String())})
+}
+
+func NewAdminSession(c *RLPAClient) AdminSession {
+	held, _ := c.LeaseInfo()
+	session := AdminSession{
+		Serial:       c.Serial,
+		ManageID:     c.ID(),
+		RemoteAddr:   c.RemoteAddr(),
+		WorkMode:     WorkModeName(c.WorkMode()),
+		ConnectedAt:  c.ConnectedAt,
+		DurationMS:   time.Since(c.ConnectedAt).Milliseconds(),
+		APILocked:    held,
+		APDUSent:     c.APDUSent.Load(),
+		APDUReceived: c.APDUReceived.Load(),
+	}
+	if chipInfo, _ := c.CachedChip(); chipInfo != nil {
+		session.EID = chipInfo.EID
+	}
+	if proc := c.Lpac(); proc != nil && proc.Running() {
+		session.LpacPID = proc.Cmd.Process.Pid
+		session.LpacArgs = proc.Args
+	}
+	return session
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func registerV1Handlers() {
+	http.HandleFunc("GET /v1/sessions/{id}/chip", v1ChipHandler)
+	http.HandleFunc("GET /v1/sessions/{id}/profiles", v1ProfilesHandler)
+	http.HandleFunc("POST /v1/sessions/{id}/profiles/{iccid}/enable", v1ProfileEnableHandler)
+	http.HandleFunc("POST /v1/sessions/{id}/profiles/{iccid}/disable", v1ProfileDisableHandler)
+	http.HandleFunc("PATCH /v1/sessions/{id}/profiles/{iccid}", v1ProfileNicknameHandler)
+	http.HandleFunc("DELETE /v1/sessions/{id}/profiles/{iccid}", v1ProfileDeleteHandler)
+}
+
+func v1ChipHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	result, ok := runLpacCommand(w, r, c, "chip", "info")
+	if !ok {
+		return
+	}
+	var info LpacChipInfo
+	if err := json.Unmarshal(result.Data, &info); err != nil {
+		writeLpacParseError(w, c, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewChipInfo(&info))
+}
+
+func v1ProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	result, ok := runLpacCommand(w, r, c, "profile", "list")
+	if !ok {
+		return
+	}
+	var lpacProfiles []LpacProfile
+	if err := json.Unmarshal(result.Data, &lpacProfiles); err != nil {
+		writeLpacParseError(w, c, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewProfiles(lpacProfiles))
+}
+
+func v1ProfileEnableHandler(w http.ResponseWriter, r *http.Request) {
+	v1ProfileAction(w, r, "enable")
+}
+
+func v1ProfileDisableHandler(w http.ResponseWriter, r *http.Request) {
+	v1ProfileAction(w, r, "disable")
+}
+
+func v1ProfileDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	v1ProfileAction(w, r, "delete")
+}
+
+func v1ProfileNicknameHandler(w http.ResponseWriter, r *http.Request) {
+	var payload NicknameRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "bad request")
+		return
+	}
+	// SGP.22 profileNickname 最长 64 字节
+	if len(payload.Nickname) > 64 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "nickname longer than 64 bytes")
+		return
+	}
+	v1ProfileAction(w, r, "nickname", payload.Nickname)
+}
+
+// v1ProfileAction 执行 profile {action} {iccid} [args...]
+func v1ProfileAction(w http.ResponseWriter, r *http.Request, action string, args ...string) {
+	c, ok := authClient(w, r)
+	if !ok {
+		return
+	}
+	iccid := r.PathValue("iccid")
+	if !iccidRegexp.MatchString(iccid) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid iccid")
+		return
+	}
+	_, ok = runLpacCommand(w, r, c, append([]string{"profile", action, iccid}, args...)...)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, ProfileActionResponse{ICCID: iccid, Action: action})
+}
+
+// runLpacCommand 检查策略后执行命令，lpac 失败时以 502 返回解析后的错误
+func runLpacCommand(w http.ResponseWriter, r *http.Request, c *RLPAClient, args ...string) (*Payload, bool) {
+	lease, ok := requireLease(w, r, c)
+	if !ok {
+		return nil, false
+	}
+	if !authorizeCommand(w, r, c, args) {
+		return nil, false
+	}
+	job, ok := runJob(w, r, c, lease, args)
+	if !ok {
+		return nil, false
+	}
+	if job.Stdout == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "%s", job.Error)
+		return nil, false
+	}
+	if job.Stdout.Error != nil {
+		writeJSON(w, http.StatusBadGateway, job.Stdout.Error)
+		return nil, false
+	}
+	return job.Stdout.Payload, true
+}
+
+func writeLpacParseError(w http.ResponseWriter, c *RLPAClient, err error) {
+	c.ErrLog("failed to parse lpac output: " + err.Error())
+	w.WriteHeader(http.StatusBadGateway)
+	fmt.Fprintf(w, "failed to parse lpac output")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func NewChipInfo(info *LpacChipInfo) ChipInfo {
+	return ChipInfo{
+		EID:         info.EID,
+		DefaultSMDP: deref(info.EuiccConfiguredAddresses.DefaultDpAddress),
+		RootSMDS:    deref(info.EuiccConfiguredAddresses.RootDsAddress),
+		EUICCInfo2:  info.EUICCInfo2,
+	}
+}
+
+func NewProfiles(lpacProfiles []LpacProfile) []Profile {
+	profiles := make([]Profile, 0, len(lpacProfiles))
+	for _, p := range lpacProfiles {
+		profiles = append(profiles, Profile{
+			ICCID:           p.ICCID,
+			ISDPAID:         p.ISDPAID,
+			State:           p.ProfileState,
+			Nickname:        deref(p.ProfileNickname),
+			ServiceProvider: deref(p.ServiceProviderName),
+			Name:            deref(p.ProfileName),
+			Class:           deref(p.ProfileClass),
+			IconType:        deref(p.IconType),
+			Icon:            deref(p.Icon),
+		})
+	}
+	return profiles
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
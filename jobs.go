@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+
+	// 每个会话保留的已结束任务数量
+	maxFinishedJobs = 32
+)
+
+var ErrJobQueueClosed = errors.New("rlpa client disconnected")
+
+// Job 一条排队执行的 lpac 命令
+type Job struct {
+	ID         string       `json:"id"`
+	Args       []string     `json:"args"`
+	Status     string       `json:"status"`
+	Stdout     *ShellResult `json:"stdout,omitempty"`
+	Stderr     string       `json:"stderr"`
+	ExitCode   *int         `json:"exit_code,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	StartedAt  *time.Time   `json:"started_at,omitempty"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	DurationMS int64        `json:"duration_ms"`
+
+	done chan struct{}
+	proc *LpacProcess
+}
+
+// Done 任务结束时关闭
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// JobQueue 按顺序执行同一会话的 lpac 命令
+type JobQueue struct {
+	mu       sync.Mutex
+	client   *RLPAClient
+	jobs     map[string]*Job
+	order    []string
+	pending  []*Job
+	wakeup   chan struct{}
+	closed   chan struct{}
+	isClosed bool
+}
+
+func NewJobQueue(c *RLPAClient) *JobQueue {
+	q := &JobQueue{
+		client: c,
+		jobs:   make(map[string]*Job),
+		wakeup: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Submit 添加任务，返回的指针只能用于等待 Done，读取状态请使用 Get
+func (q *JobQueue) Submit(args []string) (*Job, error) {
+	id, err := randomString("0123456789abcdef", 12)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:        id,
+		Args:      args,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed {
+		return nil, ErrJobQueueClosed
+	}
+	q.jobs[id] = job
+	q.order = append(q.order, id)
+	q.pending = append(q.pending, job)
+	q.prune()
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get 返回任务状态的副本
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, exists := q.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Cancel 取消排队中的任务，或结束正在运行的 lpac 进程
+func (q *JobQueue) Cancel(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, exists := q.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	switch job.Status {
+	case JobQueued:
+		for i, pending := range q.pending {
+			if pending == job {
+				q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		q.finish(job, JobCanceled, "canceled before start")
+	case JobRunning:
+		job.Status = JobCanceled
+		if job.proc != nil && job.proc.Running() {
+			if err := job.proc.Cmd.Process.Kill(); err != nil {
+				q.client.ErrLog("Failed to kill lpac process: " + err.Error())
+			}
+		}
+	}
+	return *job, true
+}
+
+// Close 停止执行并让所有未结束的任务失败
+func (q *JobQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed {
+		return
+	}
+	q.isClosed = true
+	close(q.closed)
+	for _, job := range q.pending {
+		q.finish(job, JobFailed, ErrJobQueueClosed.Error())
+	}
+	q.pending = nil
+}
+
+func (q *JobQueue) run() {
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-q.wakeup:
+		}
+		for {
+			job := q.next()
+			if job == nil {
+				break
+			}
+			q.execute(job)
+		}
+	}
+}
+
+func (q *JobQueue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed || len(q.pending) == 0 {
+		return nil
+	}
+	job := q.pending[0]
+	q.pending = q.pending[1:]
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+	return job
+}
+
+func (q *JobQueue) execute(job *Job) {
+	c := q.client
+	c.DebugLog(fmt.Sprint("job ", job.ID, " command ", job.Args))
+	proc, err := c.processOpenLpac(job.Args...)
+	if err != nil {
+		q.mu.Lock()
+		q.finish(job, JobFailed, "failed to open lpac: "+err.Error())
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Lock()
+	job.proc = proc
+	// 启动 lpac 期间收到的取消请求还没有结束进程
+	if job.Status == JobCanceled {
+		if err = proc.Cmd.Process.Kill(); err != nil {
+			c.ErrLog("Failed to kill lpac process: " + err.Error())
+		}
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-proc.Exited:
+	case <-q.closed:
+		q.mu.Lock()
+		q.finish(job, JobFailed, ErrJobQueueClosed.Error())
+		q.mu.Unlock()
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.Stderr = proc.Stderr
+	exitCode := proc.ExitCode
+	job.ExitCode = &exitCode
+	if proc.Result != nil {
+		job.Stdout = &ShellResult{Payload: proc.Result, Error: DecodeLpacError(proc.Result)}
+	}
+	switch {
+	case job.Status == JobCanceled:
+		q.finish(job, JobCanceled, "canceled")
+	case proc.Result == nil:
+		q.finish(job, JobFailed, "lpac exited without result")
+	case proc.Result.Code != 0:
+		q.finish(job, JobFailed, job.Stdout.Error.Error())
+	default:
+		q.finish(job, JobSucceeded, "")
+	}
+}
+
+// finish 调用时必须持有 q.mu
+func (q *JobQueue) finish(job *Job, status, errMsg string) {
+	if job.finished() {
+		return
+	}
+	now := time.Now()
+	job.Status = status
+	job.Error = errMsg
+	job.FinishedAt = &now
+	if job.StartedAt != nil {
+		job.DurationMS = now.Sub(*job.StartedAt).Milliseconds()
+	}
+	job.proc = nil
+	close(job.done)
+}
+
+// prune 删除最早的已结束任务，调用时必须持有 q.mu
+func (q *JobQueue) prune() {
+	finished := 0
+	for _, id := range q.order {
+		if q.jobs[id].finished() {
+			finished++
+		}
+	}
+	kept := q.order[:0]
+	for _, id := range q.order {
+		if finished > maxFinishedJobs && q.jobs[id].finished() {
+			delete(q.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	q.order = kept
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const leaseHeader = "Lease"
+
+// 租约结束原因
+const (
+	LeaseExpired  = "expired"
+	LeaseReleased = "released"
+	LeaseClosed   = "closed"
+)
+
+var (
+	ErrLeaseHeld     = errors.New("api lease is held by another client")
+	ErrLeaseNotHeld  = errors.New("api lease required, call connect first")
+	ErrLeaseMismatch = errors.New("api lease token mismatch")
+)
+
+// APILease 通过 connect 获得的 API 独占租约，keepalive 续期，过期或 disconnect 后结束
+type APILease struct {
+	Token     string
+	ExpiresAt time.Time
+	timer     *time.Timer
+	done      chan struct{}
+	reason    string
+}
+
+// Done 在租约结束时关闭
+func (l *APILease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Reason 返回租约结束原因，仅在 Done 关闭后有效
+func (l *APILease) Reason() string {
+	return l.reason
+}
+
+// leaseDone 返回租约的 Done，没有租约时返回 nil，select 时永远不会触发
+func leaseDone(l *APILease) <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.done
+}
+
+// leaseState 保存连接当前的租约
+type leaseState struct {
+	mu      sync.Mutex
+	current *APILease
+}
+
+// AcquireLease 获取 API 租约并返回 token 和过期时间，已被占用时返回 ErrLeaseHeld
+// 过期时间在持有锁时读取，之后的续期会修改租约中的值
+func (c *RLPAClient) AcquireLease() (string, time.Time, error) {
+	token, err := randomString("0123456789abcdef", 32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c.lease.mu.Lock()
+	defer c.lease.mu.Unlock()
+	// Close 在设置 closing 之后结束租约，之后不能再获取
+	if c.Closing() {
+		return "", time.Time{}, ErrJobQueueClosed
+	}
+	if c.lease.current != nil {
+		return "", time.Time{}, ErrLeaseHeld
+	}
+	timeout := CFG().KeepaliveTimeout
+	l := &APILease{
+		Token:     token,
+		ExpiresAt: time.Now().Add(timeout),
+		done:      make(chan struct{}),
+	}
+	l.timer = time.AfterFunc(timeout, func() {
+		c.endLease(l, LeaseExpired)
+	})
+	c.lease.current = l
+	c.Events.Publish(EventLifecycle, LifecycleEvent{State: "api_connected"})
+	return l.Token, l.ExpiresAt, nil
+}
+
+// Lease 校验 token 并返回当前租约
+func (c *RLPAClient) Lease(token string) (*APILease, error) {
+	c.lease.mu.Lock()
+	defer c.lease.mu.Unlock()
+	return c.checkLeaseLocked(token)
+}
+
+// RenewLease 续期租约，返回新的过期时间
+func (c *RLPAClient) RenewLease(token string) (time.Time, error) {
+	c.lease.mu.Lock()
+	defer c.lease.mu.Unlock()
+	l, err := c.checkLeaseLocked(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	timeout := CFG().KeepaliveTimeout
+	l.ExpiresAt = time.Now().Add(timeout)
+	l.timer.Reset(timeout)
+	return l.ExpiresAt, nil
+}
+
+// ReleaseLease 主动释放租约
+func (c *RLPAClient) ReleaseLease(token string) error {
+	l, err := c.Lease(token)
+	if err != nil {
+		return err
+	}
+	c.endLease(l, LeaseReleased)
+	return nil
+}
+
+// LeaseInfo 返回租约是否被持有以及过期时间
+func (c *RLPAClient) LeaseInfo() (bool, time.Time) {
+	c.lease.mu.Lock()
+	defer c.lease.mu.Unlock()
+	if c.lease.current == nil {
+		return false, time.Time{}
+	}
+	return true, c.lease.current.ExpiresAt
+}
+
+// DisconnectAPI 结束当前租约，等待中的请求会收到通知
+func (c *RLPAClient) DisconnectAPI() {
+	c.lease.mu.Lock()
+	l := c.lease.current
+	c.lease.mu.Unlock()
+	if l != nil {
+		c.endLease(l, LeaseClosed)
+	}
+}
+
+func (c *RLPAClient) checkLeaseLocked(token string) (*APILease, error) {
+	if c.lease.current == nil {
+		return nil, ErrLeaseNotHeld
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.lease.current.Token)) != 1 {
+		return nil, ErrLeaseMismatch
+	}
+	return c.lease.current, nil
+}
+
+func (c *RLPAClient) endLease(l *APILease, reason string) {
+	c.lease.mu.Lock()
+	if c.lease.current != l {
+		c.lease.mu.Unlock()
+		return
+	}
+	c.lease.current = nil
+	l.timer.Stop()
+	l.reason = reason
+	close(l.done)
+	c.lease.mu.Unlock()
+	c.DebugLog("API lease " + reason)
+	c.Events.Publish(EventLifecycle, LifecycleEvent{State: "api_disconnected", Reason: reason})
+}
+
+// requireLease 要求请求携带有效的租约，失败时写入响应，所有执行 lpac 的接口都需要租约
+func requireLease(w http.ResponseWriter, r *http.Request, c *RLPAClient) (*APILease, bool) {
+	l, err := c.Lease(r.Header.Get(leaseHeader))
+	if err != nil {
+		writeLeaseError(w, err)
+		return nil, false
+	}
+	return l, true
+}
+
+func writeLeaseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrLeaseHeld):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, ErrLeaseNotHeld):
+		w.WriteHeader(http.StatusPreconditionRequired)
+	case errors.Is(err, ErrLeaseMismatch):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, ErrJobQueueClosed):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	fmt.Fprintf(w, "%s", err.Error())
+}
+
+// writeLeaseEnded 租约在请求执行期间结束时的响应
+func writeLeaseEnded(w http.ResponseWriter, l *APILease) {
+	if l.Reason() == LeaseExpired {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	} else {
+		w.WriteHeader(http.StatusConflict)
+	}
+	fmt.Fprintf(w, "api lease %s", l.Reason())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// unixPrefix API 监听地址中 unix:/path 表示 Unix domain socket
+const unixPrefix = "unix:"
+
+// parseListenAddr 检查监听地址，返回 net.Listen 使用的 network 和 address
+func parseListenAddr(addr string, allowUnix bool) (string, string, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if !allowUnix {
+			return "", "", errors.New(addr + ": unix sockets are only supported by the api")
+		}
+		if path == "" {
+			return "", "", errors.New(addr + ": missing socket path")
+		}
+		return "unix", path, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", errors.New(addr + ": invalid port " + port)
+	}
+	return "tcp", addr, nil
+}
+
+// unixSockets 正在监听的 socket 文件，退出时删除
+var unixSockets struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// listen 监听 TCP 地址或 Unix domain socket，上次运行残留的 socket 文件会被删除
+// socket 文件的权限为 api.unix_socket_mode
+func listen(addr string) (net.Listener, error) {
+	network, address, err := parseListenAddr(addr, true)
+	if err != nil {
+		return nil, err
+	}
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if err = removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(address, CFG().APIUnixSocketMode); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	unixSockets.mu.Lock()
+	unixSockets.paths = append(unixSockets.paths, address)
+	unixSockets.mu.Unlock()
+	return listener, nil
+}
+
+// WatchShutdown 收到 SIGINT 或 SIGTERM 时删除 socket 文件并退出
+func WatchShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("Shutting down on " + sig.String())
+	unixSockets.mu.Lock()
+	for _, path := range unixSockets.paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to remove socket file", "path", path, "error", err)
+		}
+	}
+	unixSockets.mu.Unlock()
+	os.Exit(0)
+}
+
+// removeStaleSocket 删除没有进程监听的 socket 文件，不是 socket 或仍在使用时返回错误
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return errors.New(path + " is in use by another process")
+	}
+	return os.Remove(path)
+}
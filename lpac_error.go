@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	LpacErrConfirmCodeRequired = "confirm_code_required"
+	LpacErrConfirmCodeWrong    = "confirm_code_wrong"
+	LpacErrConfirmCodeRetries  = "confirm_code_retries"
+	LpacErrMatchingIDRefused   = "matching_id_refused"
+	LpacErrEIDRefused          = "eid_refused"
+	LpacErrOrderExpired        = "order_expired"
+	LpacErrRetriesExceeded     = "retries_exceeded"
+	LpacErrInsufficientMemory  = "insufficient_memory"
+	LpacErrICCIDExists         = "iccid_exists"
+	LpacErrCertificate         = "certificate"
+	LpacErrProfileMetadata     = "profile_metadata"
+	LpacErrHTTP                = "http"
+	LpacErrSMDP                = "smdp"
+	LpacErrEUICC               = "euicc"
+	LpacErrUnknown             = "unknown"
+)
+
+// SGP.22 中 Subject Code 均以 8 开头，例如 8.2.7 3.8
+var (
+	statusCodeRegexp = regexp.MustCompile(`\b(8(?:\.\d{1,2}){1,2})\b\D{1,20}\b(\d{1,2}\.\d{1,2})\b`)
+	httpStatusRegexp = regexp.MustCompile(`(?i)http\D{0,16}([1-5]\d\d)\b`)
+)
+
+// ref: SGP.22 5.2.6 Subject Code / Reason Code
+var subjectCodes = map[string]string{
+	"8.1":    "eUICC",
+	"8.1.1":  "EID",
+	"8.1.2":  "EUM Certificate",
+	"8.1.3":  "eUICC Certificate",
+	"8.2":    "Profile",
+	"8.2.1":  "Profile ICCID",
+	"8.2.5":  "Profile Type",
+	"8.2.6":  "Matching ID",
+	"8.2.7":  "Confirmation Code",
+	"8.8":    "SM-DP+",
+	"8.8.1":  "SM-DP+ Address",
+	"8.8.2":  "SM-DP+ Certificate",
+	"8.8.5":  "Download Order",
+	"8.9":    "SM-DS",
+	"8.10.1": "Transaction ID",
+	"8.11.1": "CI Public Key",
+}
+
+var reasonCodes = map[string]string{
+	"1.1":  "Unauthorized",
+	"1.2":  "Not Allowed",
+	"2.1":  "Invalid",
+	"2.2":  "Mandatory Element Missing",
+	"3.1":  "Unknown",
+	"3.3":  "Already in Use",
+	"3.7":  "Unavailable",
+	"3.8":  "Refused",
+	"3.9":  "Unknown",
+	"3.10": "Invalid Association",
+	"4.2":  "Execution Error",
+	"4.8":  "Insufficient Memory",
+	"4.10": "Time to Live Expired",
+	"6.1":  "Verification Failed",
+	"6.3":  "Expired",
+	"6.4":  "Maximum Number of Retries Exceeded",
+}
+
+// 已知的 SM-DP+ 状态码组合
+var statusCodeKinds = map[string]string{
+	"8.2.7 2.2":  LpacErrConfirmCodeRequired,
+	"8.2.7 3.8":  LpacErrConfirmCodeWrong,
+	"8.2.7 6.4":  LpacErrConfirmCodeRetries,
+	"8.2.6 3.8":  LpacErrMatchingIDRefused,
+	"8.2.6 3.9":  LpacErrMatchingIDRefused,
+	"8.1.1 3.8":  LpacErrEIDRefused,
+	"8.8.5 4.10": LpacErrOrderExpired,
+	"8.8.5 6.4":  LpacErrRetriesExceeded,
+	"8.11.1 3.9": LpacErrCertificate,
+}
+
+// lpac es10b 错误原因
+var euiccReasonKinds = map[string]string{
+	"install_failed_due_to_insufficient_memory_for_profile": LpacErrInsufficientMemory,
+	"install_failed_due_to_iccid_already_exists_on_euicc":   LpacErrICCIDExists,
+	"ci_pk_unknown":       LpacErrCertificate,
+	"invalid_certificate": LpacErrCertificate,
+}
+
+// 设备上显示的提示，按语言区分
+var lpacErrorMessages = map[string]map[string]string{
+	"en": {
+		LpacErrConfirmCodeRequired: "Confirmation Code required\nAppend it to the activation code after " + confirmCodeSeparator,
+		LpacErrConfirmCodeWrong:    "Confirmation Code is wrong",
+		LpacErrConfirmCodeRetries:  "Too many wrong Confirmation Codes",
+		LpacErrMatchingIDRefused:   "Activation code refused by SM-DP+",
+		LpacErrEIDRefused:          "Profile is reserved for another eSIM",
+		LpacErrOrderExpired:        "Activation code expired",
+		LpacErrRetriesExceeded:     "Too many download attempts",
+		LpacErrInsufficientMemory:  "Not enough memory on eSIM",
+		LpacErrICCIDExists:         "Profile already installed",
+		LpacErrCertificate:         "SM-DP+ certificate not trusted",
+		LpacErrProfileMetadata:     "Invalid profile metadata",
+		LpacErrHTTP:                "Cannot reach SM-DP+",
+		LpacErrSMDP:                "Refused by SM-DP+",
+		LpacErrEUICC:               "eSIM error",
+		LpacErrUnknown:             "Download failed",
+	},
+	"zh": {
+		LpacErrConfirmCodeRequired: "需要确认码\n请在激活码后输入 " + confirmCodeSeparator + " 和确认码",
+		LpacErrConfirmCodeWrong:    "确认码错误",
+		LpacErrConfirmCodeRetries:  "确认码错误次数过多",
+		LpacErrMatchingIDRefused:   "SM-DP+ 拒绝了该激活码",
+		LpacErrEIDRefused:          "该配置文件已绑定其他 eSIM",
+		LpacErrOrderExpired:        "激活码已过期",
+		LpacErrRetriesExceeded:     "下载次数过多",
+		LpacErrInsufficientMemory:  "eSIM 存储空间不足",
+		LpacErrICCIDExists:         "配置文件已安装",
+		LpacErrCertificate:         "SM-DP+ 证书不受信任",
+		LpacErrProfileMetadata:     "配置文件元数据无效",
+		LpacErrHTTP:                "无法连接 SM-DP+",
+		LpacErrSMDP:                "SM-DP+ 拒绝请求",
+		LpacErrEUICC:               "eSIM 错误",
+		LpacErrUnknown:             "下载失败",
+	},
+}
+
+// LpacError 解析后的 lpac 错误，用于日志和 API 输出
+type LpacError struct {
+	Kind        string `json:"kind"`
+	Function    string `json:"function"`
+	Detail      string `json:"detail,omitempty"`
+	SubjectCode string `json:"subject_code,omitempty"`
+	ReasonCode  string `json:"reason_code,omitempty"`
+	HTTPStatus  int    `json:"http_status,omitempty"`
+	Description string `json:"description"`
+}
+
+func (e *LpacError) Error() string {
+	msg := e.Kind + ": " + e.Description
+	if e.Function != "" {
+		msg = e.Function + ": " + msg
+	}
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	return msg
+}
+
+// Localized 返回设备上显示的简短提示
+func (e *LpacError) Localized(lang string) string {
+	messages, ok := lpacErrorMessages[lang]
+	if !ok {
+		messages = lpacErrorMessages["en"]
+	}
+	msg := messages[e.Kind]
+	switch e.Kind {
+	case LpacErrSMDP:
+		msg += "\n" + e.SubjectCode + " " + e.ReasonCode
+	case LpacErrHTTP:
+		if e.HTTPStatus != 0 {
+			msg += fmt.Sprint("\nHTTP ", e.HTTPStatus)
+		}
+	}
+	return msg
+}
+
+// DecodeLpacError 解析 lpac 返回的错误 payload，code 为 0 时返回 nil
+func DecodeLpacError(data *Payload) *LpacError {
+	if data == nil {
+		return &LpacError{Kind: LpacErrUnknown, Description: "no lpac result"}
+	}
+	if data.Code == 0 {
+		return nil
+	}
+	e := &LpacError{
+		Kind:     LpacErrUnknown,
+		Function: data.Message,
+		Detail:   payloadDetail(data.Data),
+	}
+	detail := strings.ToLower(e.Detail)
+	if match := statusCodeRegexp.FindStringSubmatch(e.Detail); match != nil {
+		e.SubjectCode, e.ReasonCode = match[1], match[2]
+		e.Kind = LpacErrSMDP
+		if kind, ok := statusCodeKinds[e.SubjectCode+" "+e.ReasonCode]; ok {
+			e.Kind = kind
+		}
+		e.Description = describeStatusCode(e.SubjectCode, e.ReasonCode)
+		return e
+	}
+	if match := httpStatusRegexp.FindStringSubmatch(e.Detail); match != nil {
+		e.HTTPStatus, _ = strconv.Atoi(match[1])
+	}
+	switch {
+	case strings.Contains(detail, "insufficient_memory") || strings.Contains(detail, "insufficient memory"):
+		e.Kind = LpacErrInsufficientMemory
+		e.Description = "insufficient memory on eUICC"
+	case strings.HasPrefix(e.Function, "es10"):
+		e.Kind = LpacErrEUICC
+		if kind, ok := euiccReasonKinds[detail]; ok {
+			e.Kind = kind
+		}
+		e.Description = "eUICC returned " + orDefault(e.Detail, "an error")
+	case strings.HasPrefix(e.Function, "es8p"):
+		e.Kind = LpacErrProfileMetadata
+		e.Description = "failed to parse profile metadata"
+	case e.HTTPStatus != 0 || strings.Contains(detail, "http") || strings.Contains(detail, "curl"):
+		e.Kind = LpacErrHTTP
+		e.Description = "HTTP request to SM-DP+ failed"
+	case strings.HasPrefix(e.Function, "es9p"):
+		// 没有状态码的 es9p 错误一般是网络请求失败
+		e.Kind = LpacErrHTTP
+		e.Description = "SM-DP+ request failed"
+	case strings.Contains(detail, "confirmation code"):
+		e.Kind = LpacErrConfirmCodeRequired
+		e.Description = "confirmation code required"
+	default:
+		e.Description = orDefault(e.Detail, "lpac returned code "+strconv.Itoa(data.Code))
+	}
+	return e
+}
+
+func describeStatusCode(subjectCode, reasonCode string) string {
+	subject := orDefault(subjectCodes[subjectCode], "Subject "+subjectCode)
+	reason := orDefault(reasonCodes[reasonCode], "Reason "+reasonCode)
+	return subject + ": " + reason
+}
+
+// payloadDetail 将 lpac data 字段转换为字符串，data 一般为字符串或 null
+func payloadDetail(data json.RawMessage) string {
+	if len(data) == 0 || string(data) == "null" {
+		return ""
+	}
+	var detail string
+	if json.Unmarshal(data, &detail) == nil {
+		return strings.TrimSpace(detail)
+	}
+	return string(data)
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -1,55 +1,121 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"strings"
+	"time"
 )
 
-func init() {
-	Credentials = make(map[string]string)
-}
-
 func main() {
 	debug := flag.Bool("debug", false, "sets log level to debug")
 	showHelp := flag.Bool("help", false, "show help info")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "toml config file")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	configFlags := RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
 	if *showHelp {
 		help := `rlpa-server
 
 Arguments:
-	-debug	enable debug output
+	-config	toml config file, see config.example.toml
+	-check-config	validate the configuration, certificates and policy file, then exit
+	-socket-port	rlpa socket port
+	-socket-listen	comma separated rlpa socket addresses
+	-api-port	http management api port
+	-api-listen	comma separated api addresses, unix:/path for unix sockets
+	-lpac-folder	lpac binary folder
+	-log-level	debug, info, warn or error
+	-debug	same as -log-level debug
 	-help	show help info
 
+Settings are applied in order: defaults, config file, environment variables, arguments.
+
 Environment Variables:
-	LPAC_FOLDER	lpac binary folder name
-	SOCKET_PORT	rlpa socket port
-	API_PORT	http management api port
-`
+	CONFIG_FILE	toml config file, same as -config
+` + ConfigHelp()
 		print(help)
 		return
 	}
-	slog.SetLogLoggerLevel(slog.LevelInfo)
-	if *debug {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+	source := ConfigSource{File: *configFile, Flags: configFlags()}
+	if _, ok := source.Flags["log-level"]; !ok && *debug {
+		source.Flags["log-level"] = "debug"
 	}
-	err := InitConfig()
+	if *checkConfig {
+		if err := CheckConfig(source); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration ok")
+		return
+	}
+	err := InitConfig(source)
 	if err != nil {
 		panic(err)
 	}
+	OnReload("config", ReloadConfig)
+	err = InitPendingStore()
+	if err != nil {
+		panic(err)
+	}
+	err = InitPolicy()
+	if err != nil {
+		panic(err)
+	}
+	// 连接断开时放回没有执行完的预置操作
+	Sessions.OnClose(func(c *RLPAClient) {
+		Provisioning.Release(c.Serial)
+	})
 
 	go HttpServer()
+	go WatchReload()
+	go WatchShutdown()
 
-	addr := fmt.Sprint("0.0.0.0:", CFG.SocketPort)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		panic(err)
+	var listeners []socketListener
+	for _, addr := range CFG().SocketListen {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			panic(err)
+		}
+		slog.Info("Start listening on tcp://" + addr)
+		listeners = append(listeners, socketListener{Listener: listener})
+	}
+	if len(CFG().SocketTLSListen) > 0 {
+		reloader, err := NewCertReloader(CFG().SocketTLSCert, CFG().SocketTLSKey, CFG().SocketTLSClientCA)
+		if err != nil {
+			panic(err)
+		}
+		OnReload("socket certificate", reloader.Reload)
+		config := reloader.TLSConfig(tls.RequireAndVerifyClientCert)
+		for _, addr := range CFG().SocketTLSListen {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			slog.Info("Start listening on tls://" + addr)
+			listeners = append(listeners, socketListener{Listener: listener, tlsConfig: config})
+		}
+	}
+	for _, listener := range listeners[1:] {
+		go serveSocket(listener)
 	}
+	serveSocket(listeners[0])
+}
+
+// socketListener RLPA 监听地址，tlsConfig 不为空时在 PROXY 头之后进行 TLS 握手
+type socketListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+}
 
-	slog.Info("Start listening on tcp://" + addr)
-	defer func(listener net.Listener) {
+// serveSocket 接受 RLPA 连接
+func serveSocket(listener socketListener) {
+	defer func(listener socketListener) {
 		errClose := listener.Close()
 		if errClose != nil {
 			slog.Error("Failed to close socket listener")
@@ -58,23 +124,67 @@ Environment Variables:
 
 	for {
 		conn, err := listener.Accept()
-		slog.Info("Accepted " + conn.RemoteAddr().String())
 		if err != nil {
 			slog.Error(err.Error())
 			continue
 		}
-
-		go handleConnection(conn)
+		go handleConnection(conn, listener.tlsConfig)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+// logLevel 当前日志级别，可通过管理 API 修改
+var logLevel slog.LevelVar
+
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+}
+
+func handleConnection(conn net.Conn, tlsConfig *tls.Config) {
+	cfg := CFG()
+	remote := conn.RemoteAddr().String()
+	if trustedProxy(conn.RemoteAddr(), cfg.ProxyTrusted) {
+		// 负载均衡转发的连接，之后使用 PROXY 头中的客户端地址
+		proxied, err := acceptProxy(conn, cfg.HandshakeTimeout)
+		if err != nil {
+			slog.Warn("Rejected proxy connection: "+err.Error(), "proxy", remote)
+			_ = conn.Close()
+			return
+		}
+		slog.Info("Accepted "+proxied.RemoteAddr().String(), "proxy", remote)
+		conn = proxied
+	} else {
+		slog.Info("Accepted " + remote)
+	}
+	if Guard.Banned(hostOf(conn.RemoteAddr())) {
+		slog.Warn("Rejected banned ip", "client", conn.RemoteAddr().String())
+		_ = conn.Close()
+		return
+	}
+	if tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		// 握手失败时不创建客户端
+		_ = tlsConn.SetDeadline(time.Now().Add(cfg.HandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Warn("TLS handshake failed: "+err.Error(), "client", conn.RemoteAddr().String())
+			_ = conn.Close()
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	conn = meteredConn{conn}
 	client := NewRLPAClient(conn)
+	Sessions.Add(client)
 
 	for {
 		// 接受 Packet
 		err := client.Packet.Recv(conn)
 		if err != nil {
+			if client.Closing() {
+				// 已由服务端关闭
+				return
+			}
 			if strings.Contains(err.Error(), "EOF") {
 				client.Close(ResultClientDisconnect)
 			} else {
@@ -97,3 +207,30 @@ func handleConnection(conn net.Conn) {
 		client.Packet = NewRLPAPacket(0, []byte{})
 	}
 }
+
+// CheckConfig 加载配置并检查证书和策略文件，不启动服务
+func CheckConfig(source ConfigSource) error {
+	c, err := LoadConfig(source)
+	if err != nil {
+		return err
+	}
+	if len(c.SocketTLSListen) > 0 {
+		if _, err = NewCertReloader(c.SocketTLSCert, c.SocketTLSKey, c.SocketTLSClientCA); err != nil {
+			return errors.New("socket tls: " + err.Error())
+		}
+	}
+	if c.APITLSCert != "" {
+		if _, err = NewCertReloader(c.APITLSCert, c.APITLSKey, c.APITLSClientCA); err != nil {
+			return errors.New("api tls: " + err.Error())
+		}
+	}
+	if c.PolicyFile != "" {
+		if _, err = LoadPolicy(c.PolicyFile); err != nil {
+			return err
+		}
+	}
+	if _, err = os.Stat(c.LpacPath); err != nil {
+		return errors.New("lpac not found: " + err.Error())
+	}
+	return nil
+}
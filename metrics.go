@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 手写的 Prometheus 文本格式指标，避免引入 client_golang
+
+var (
+	lpacDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	apduRTTBuckets      = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+var closeResultNames = map[int]string{
+	ResultFinished:         "finished",
+	ResultClientDisconnect: "client_disconnect",
+	ResultError:            "error",
+}
+
+// Metrics 服务端的全部指标
+var Metrics = struct {
+	SessionsClosed *CounterVec
+	Downloads      *CounterVec
+	Notifications  *CounterVec
+	LpacDuration   *Histogram
+	APDURTT        *Histogram
+	BytesIn        atomic.Uint64
+	BytesOut       atomic.Uint64
+	LpacRunning    atomic.Int64
+}{
+	SessionsClosed: NewCounterVec(),
+	Downloads:      NewCounterVec(),
+	Notifications:  NewCounterVec(),
+	LpacDuration:   NewHistogram(lpacDurationBuckets),
+	APDURTT:        NewHistogram(apduRTTBuckets),
+}
+
+// CounterVec 按单个标签值区分的计数器
+type CounterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func NewCounterVec() *CounterVec {
+	return &CounterVec{values: make(map[string]uint64)}
+}
+
+func (v *CounterVec) Inc(label string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[label]++
+}
+
+func (v *CounterVec) snapshot() map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make(map[string]uint64, len(v.values))
+	for k, n := range v.values {
+		values[k] = n
+	}
+	return values
+}
+
+// Histogram 累积分桶的直方图，单位为秒
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// meteredConn 统计 RLPA socket 收发的字节数
+type meteredConn struct {
+	net.Conn
+}
+
+func (c meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	Metrics.BytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	Metrics.BytesOut.Add(uint64(n))
+	return n, err
+}
+
+// observeLpacResult 记录 lpac 运行时长以及下载和通知的结果
+func observeLpacResult(proc *LpacProcess, result *Payload) {
+	Metrics.LpacDuration.Observe(time.Since(proc.StartedAt))
+	if len(proc.Args) < 2 {
+		return
+	}
+	outcome := "success"
+	if result == nil || result.Code != 0 {
+		outcome = "failure"
+	}
+	switch proc.Args[0] + " " + proc.Args[1] {
+	case "profile download":
+		Metrics.Downloads.Inc(outcome)
+	case "notification process":
+		Metrics.Notifications.Inc(outcome)
+	}
+}
+
+// authorizeMetrics 接受 METRICS_TOKEN 或管理员 token，两者都未配置时允许匿名访问
+func authorizeMetrics(w http.ResponseWriter, r *http.Request) bool {
+	cfg := CFG()
+	if cfg.MetricsToken == "" && cfg.AdminToken == "" {
+		return true
+	}
+	if cfg.MetricsToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MetricsToken)) == 1 {
+			return true
+		}
+	}
+	return requireAdmin(w, r)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeMetrics(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	sessions := make(map[string]uint64)
+	for _, mode := range []string{"none", "shell", "notification", "download", "provision"} {
+		sessions[mode] = 0
+	}
+	for _, c := range Sessions.Snapshot() {
+		sessions[WorkModeName(c.WorkMode())]++
+	}
+	writeMetricHeader(w, "rlpa_sessions_active", "gauge", "Active RLPA connections by work mode.")
+	writeLabeled(w, "rlpa_sessions_active", "work_mode", sessions)
+
+	closed := Metrics.SessionsClosed.snapshot()
+	for _, name := range closeResultNames {
+		closed[name] += 0
+	}
+	writeMetricHeader(w, "rlpa_sessions_closed_total", "counter", "Closed RLPA connections by result.")
+	writeLabeled(w, "rlpa_sessions_closed_total", "result", closed)
+
+	writeMetricHeader(w, "rlpa_profile_downloads_total", "counter", "Profile downloads by result.")
+	writeLabeled(w, "rlpa_profile_downloads_total", "result", withOutcomes(Metrics.Downloads.snapshot()))
+	writeMetricHeader(w, "rlpa_notifications_processed_total", "counter", "Notification process runs by result.")
+	writeLabeled(w, "rlpa_notifications_processed_total", "result", withOutcomes(Metrics.Notifications.snapshot()))
+
+	writeMetricHeader(w, "rlpa_lpac_duration_seconds", "histogram", "Duration of lpac processes.")
+	Metrics.LpacDuration.write(w, "rlpa_lpac_duration_seconds")
+	writeMetricHeader(w, "rlpa_apdu_rtt_seconds", "histogram", "Round-trip time of APDUs sent to the card.")
+	Metrics.APDURTT.write(w, "rlpa_apdu_rtt_seconds")
+
+	writeMetricHeader(w, "rlpa_socket_bytes_total", "counter", "Bytes on the RLPA socket.")
+	writeLabeled(w, "rlpa_socket_bytes_total", "direction", map[string]uint64{
+		"in":  Metrics.BytesIn.Load(),
+		"out": Metrics.BytesOut.Load(),
+	})
+	writeMetricHeader(w, "rlpa_lpac_running", "gauge", "Running lpac processes.")
+	fmt.Fprintf(w, "rlpa_lpac_running %d\n", Metrics.LpacRunning.Load())
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeLabeled 按标签值排序输出，保证每次抓取的顺序一致
+func writeLabeled(w io.Writer, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), values[k])
+	}
+}
+
+func withOutcomes(values map[string]uint64) map[string]uint64 {
+	values["success"] += 0
+	values["failure"] += 0
+	return values
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
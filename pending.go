@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPendingTTL time.Duration = 15 * time.Minute
+	maxPendingTTL     time.Duration = 24 * time.Hour
+	// maxPendingEntries 未过期条目的上限，6 位 PIN 时最多占全部组合的千分之一
+	maxPendingEntries = 1000
+	// maxPINAttempts 生成不重复 PIN 的最大尝试次数
+	maxPINAttempts = 32
+	// PIN 长度的范围，修改 PENDING_PIN_LENGTH 后已发出的 PIN 仍然可以使用
+	// 更短的 PIN 在条目较多时很容易被猜中
+	minPendingPINLength = 6
+	maxPendingPINLength = 16
+)
+
+var (
+	ErrPendingStoreFull = errors.New("too many pending downloads")
+	ErrPINExhausted     = errors.New("no free PIN available, try again later")
+)
+
+// PendingDownload 通过 API 登记的待下载激活码，设备端输入 PIN 即可下载
+// 只有 MatchingID 没有 PIN 的条目是预先登记的确认码，设备输入该 Matching ID 的激活码时使用
+type PendingDownload struct {
+	PIN            string    `json:"pin,omitempty"`
+	ActivationCode string    `json:"activation_code,omitempty"`
+	MatchingID     string    `json:"matching_id,omitempty"`
+	ConfirmCode    string    `json:"confirmation_code,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// pendingKey 条目在存储中的键，确认码以 Matching ID 为键，与 PIN 不会冲突
+func pendingKey(entry PendingDownload) string {
+	if entry.PIN != "" {
+		return entry.PIN
+	}
+	return confirmCodeKey(entry.MatchingID)
+}
+
+func confirmCodeKey(matchID string) string {
+	return "matching_id:" + strings.ToUpper(matchID)
+}
+
+func (p *PendingDownload) Expired() bool {
+	return time.Now().After(p.ExpiresAt)
+}
+
+type PendingStore interface {
+	// Register 保存激活码并分配一个未被占用的 PIN
+	Register(activationCode, confirmCode string, ttl time.Duration) (PendingDownload, error)
+	// Take 取出 PIN 对应的条目，取出后即失效
+	Take(pin string) (PendingDownload, bool, error)
+	// RegisterConfirmCode 为 Matching ID 登记确认码，同一 Matching ID 只保留最新的
+	RegisterConfirmCode(matchID, confirmCode string, ttl time.Duration) (PendingDownload, error)
+	// TakeConfirmCode 取出 Matching ID 对应的确认码，取出后即失效
+	TakeConfirmCode(matchID string) (string, bool, error)
+}
+
+var Pending PendingStore
+
+func InitPendingStore() error {
+	if CFG().PendingStoreFile == "" {
+		Pending = NewMemoryPendingStore()
+		return nil
+	}
+	store, err := NewFilePendingStore(CFG().PendingStoreFile)
+	if err != nil {
+		return err
+	}
+	Pending = store
+	return nil
+}
+
+type MemoryPendingStore struct {
+	mu      sync.Mutex
+	entries map[string]PendingDownload
+}
+
+func NewMemoryPendingStore() *MemoryPendingStore {
+	return &MemoryPendingStore{entries: make(map[string]PendingDownload)}
+}
+
+func (s *MemoryPendingStore) Register(activationCode, confirmCode string, ttl time.Duration) (PendingDownload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.register(activationCode, confirmCode, ttl)
+}
+
+func (s *MemoryPendingStore) register(activationCode, confirmCode string, ttl time.Duration) (PendingDownload, error) {
+	s.removeExpired()
+	if len(s.entries) >= maxPendingEntries {
+		return PendingDownload{}, ErrPendingStoreFull
+	}
+	for i := 0; i < maxPINAttempts; i++ {
+		pin, err := randomString(digits, CFG().PendingPINLength)
+		if err != nil {
+			return PendingDownload{}, err
+		}
+		if _, exists := s.entries[pin]; exists {
+			continue
+		}
+		entry := PendingDownload{
+			PIN:            pin,
+			ActivationCode: activationCode,
+			ConfirmCode:    confirmCode,
+			ExpiresAt:      time.Now().Add(ttl),
+		}
+		s.entries[pin] = entry
+		return entry, nil
+	}
+	return PendingDownload{}, ErrPINExhausted
+}
+
+func (s *MemoryPendingStore) Take(pin string) (PendingDownload, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.take(pin)
+	return entry, ok, nil
+}
+
+func (s *MemoryPendingStore) take(key string) (PendingDownload, bool) {
+	entry, exists := s.entries[key]
+	if !exists {
+		return PendingDownload{}, false
+	}
+	delete(s.entries, key)
+	if entry.Expired() {
+		return PendingDownload{}, false
+	}
+	return entry, true
+}
+
+func (s *MemoryPendingStore) RegisterConfirmCode(matchID, confirmCode string, ttl time.Duration) (PendingDownload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registerConfirmCode(matchID, confirmCode, ttl)
+}
+
+func (s *MemoryPendingStore) registerConfirmCode(matchID, confirmCode string, ttl time.Duration) (PendingDownload, error) {
+	s.removeExpired()
+	key := confirmCodeKey(matchID)
+	if _, exists := s.entries[key]; !exists && len(s.entries) >= maxPendingEntries {
+		return PendingDownload{}, ErrPendingStoreFull
+	}
+	entry := PendingDownload{
+		MatchingID:  matchID,
+		ConfirmCode: confirmCode,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	s.entries[key] = entry
+	return entry, nil
+}
+
+func (s *MemoryPendingStore) TakeConfirmCode(matchID string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.take(confirmCodeKey(matchID))
+	return entry.ConfirmCode, ok, nil
+}
+
+func (s *MemoryPendingStore) removeExpired() {
+	for pin, entry := range s.entries {
+		if entry.Expired() {
+			delete(s.entries, pin)
+		}
+	}
+}
+
+// FilePendingStore 在内存存储的基础上把条目持久化到 JSON 文件，重启后不丢失
+type FilePendingStore struct {
+	MemoryPendingStore
+	path string
+}
+
+func NewFilePendingStore(path string) (*FilePendingStore, error) {
+	s := &FilePendingStore{
+		MemoryPendingStore: MemoryPendingStore{entries: make(map[string]PendingDownload)},
+		path:               path,
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.New("Failed to read pending store: " + err.Error())
+	}
+	var entries []PendingDownload
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.New("Failed to parse pending store: " + err.Error())
+	}
+	for _, entry := range entries {
+		if !entry.Expired() {
+			s.entries[pendingKey(entry)] = entry
+		}
+	}
+	return s, nil
+}
+
+func (s *FilePendingStore) Register(activationCode, confirmCode string, ttl time.Duration) (PendingDownload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := s.register(activationCode, confirmCode, ttl)
+	if err != nil {
+		return entry, err
+	}
+	if err = s.save(); err != nil {
+		delete(s.entries, entry.PIN)
+		return PendingDownload{}, err
+	}
+	return entry, nil
+}
+
+func (s *FilePendingStore) Take(pin string) (PendingDownload, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.take(pin)
+	if !ok {
+		return entry, false, nil
+	}
+	return entry, true, s.save()
+}
+
+func (s *FilePendingStore) RegisterConfirmCode(matchID, confirmCode string, ttl time.Duration) (PendingDownload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := confirmCodeKey(matchID)
+	previous, existed := s.entries[key]
+	entry, err := s.registerConfirmCode(matchID, confirmCode, ttl)
+	if err != nil {
+		return entry, err
+	}
+	if err = s.save(); err != nil {
+		delete(s.entries, key)
+		if existed {
+			s.entries[key] = previous
+		}
+		return PendingDownload{}, err
+	}
+	return entry, nil
+}
+
+func (s *FilePendingStore) TakeConfirmCode(matchID string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.take(confirmCodeKey(matchID))
+	if !ok {
+		return "", false, nil
+	}
+	return entry.ConfirmCode, true, s.save()
+}
+
+// save 先写临时文件再重命名，避免写入中断导致文件损坏
+func (s *FilePendingStore) save() error {
+	entries := make([]PendingDownload, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
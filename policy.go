@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+
+	// 执行破坏性命令时需要在该 header 中写入子命令，例如 Confirm: profile delete
+	confirmHeader = "Confirm"
+)
+
+// CommandRule 允许执行的 lpac 子命令，Command 为 * 时匹配全部
+type CommandRule struct {
+	Command string `json:"command"`
+	// Flags 允许的参数，为空时不限制
+	Flags       []string `json:"flags,omitempty"`
+	Destructive bool     `json:"destructive,omitempty"`
+}
+
+type RolePolicy struct {
+	Allow []CommandRule `json:"allow"`
+}
+
+// RoleAssignment 为来自指定网络的连接指定角色
+// 不按 EID 匹配，EID 由设备自己回复的 APDU 读出，任何设备都可以冒充
+type RoleAssignment struct {
+	Role     string   `json:"role"`
+	Networks []string `json:"networks"`
+	prefixes []netip.Prefix
+}
+
+type Policy struct {
+	DefaultRole string                `json:"default_role"`
+	Roles       map[string]RolePolicy `json:"roles"`
+	// Assign 按顺序匹配，第一个匹配的生效，都不匹配时使用 DefaultRole
+	Assign []RoleAssignment `json:"assign,omitempty"`
+}
+
+// PolicyDecision 策略检查结果，被拒绝时作为 403 响应体
+type PolicyDecision struct {
+	Allowed       bool   `json:"-"`
+	Error         string `json:"error,omitempty"`
+	Role          string `json:"role"`
+	Command       string `json:"command"`
+	Reason        string `json:"reason,omitempty"`
+	ConfirmHeader string `json:"confirm_header,omitempty"`
+}
+
+var CommandPolicy = DefaultPolicy()
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		DefaultRole: RoleUser,
+		Roles: map[string]RolePolicy{
+			RoleUser: {Allow: []CommandRule{
+				{Command: "chip info"},
+				{Command: "profile list"},
+				{Command: "profile enable"},
+				{Command: "profile disable"},
+				{Command: "profile nickname"},
+				{Command: "profile download"},
+				{Command: "profile discovery"},
+				{Command: "profile delete", Destructive: true},
+				{Command: "notification list"},
+				{Command: "notification process"},
+				{Command: "notification remove", Destructive: true},
+				{Command: "version"},
+			}},
+			RoleAdmin: {Allow: []CommandRule{
+				{Command: "profile delete", Destructive: true},
+				{Command: "notification remove", Destructive: true},
+				{Command: "chip purge", Destructive: true},
+				{Command: "*"},
+			}},
+		},
+	}
+}
+
+func InitPolicy() error {
+	if CFG().PolicyFile == "" {
+		return nil
+	}
+	policy, err := LoadPolicy(CFG().PolicyFile)
+	if err != nil {
+		return err
+	}
+	CommandPolicy = policy
+	return nil
+}
+
+// LoadPolicy 读取并检查策略文件
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Failed to read policy file: " + err.Error())
+	}
+	var policy Policy
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, errors.New("Failed to parse policy file: " + err.Error())
+	}
+	if err = policy.Validate(); err != nil {
+		return nil, errors.New("Invalid policy file: " + err.Error())
+	}
+	return &policy, nil
+}
+
+func (p *Policy) Validate() error {
+	if _, exists := p.Roles[p.DefaultRole]; !exists {
+		return errors.New("default_role " + p.DefaultRole + " is not defined in roles")
+	}
+	for name, role := range p.Roles {
+		for _, rule := range role.Allow {
+			if strings.TrimSpace(rule.Command) == "" {
+				return errors.New("role " + name + " has a rule without command")
+			}
+		}
+	}
+	for i := range p.Assign {
+		assign := &p.Assign[i]
+		if _, exists := p.Roles[assign.Role]; !exists {
+			return errors.New("assigned role " + assign.Role + " is not defined in roles")
+		}
+		if len(assign.Networks) == 0 {
+			return errors.New("assignment of role " + assign.Role + " has no networks")
+		}
+		assign.prefixes = assign.prefixes[:0]
+		for _, network := range assign.Networks {
+			prefix, err := parseProxyTrusted(network)
+			if err != nil {
+				return errors.New("role " + assign.Role + " has an invalid network " + network)
+			}
+			assign.prefixes = append(assign.prefixes, prefix)
+		}
+	}
+	return nil
+}
+
+// RoleFor 按设备地址返回连接的角色
+func (p *Policy) RoleFor(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return p.DefaultRole
+	}
+	for _, assign := range p.Assign {
+		for _, prefix := range assign.prefixes {
+			if prefix.Contains(addr.Unmap()) {
+				return assign.Role
+			}
+		}
+	}
+	return p.DefaultRole
+}
+
+// Check 按规则顺序匹配命令，第一个匹配的规则生效
+func (p *Policy) Check(role string, args []string, confirm string) PolicyDecision {
+	words, flags := splitLpacArgs(args)
+	decision := PolicyDecision{Role: role, Command: strings.Join(words, " ")}
+	deny := func(reason string) PolicyDecision {
+		decision.Error = "forbidden"
+		decision.Reason = reason
+		return decision
+	}
+	rolePolicy, exists := p.Roles[role]
+	if !exists {
+		return deny("unknown role")
+	}
+	for _, rule := range rolePolicy.Allow {
+		ruleWords := strings.Fields(rule.Command)
+		if rule.Command != "*" && (len(words) < len(ruleWords) || !slices.Equal(ruleWords, words[:len(ruleWords)])) {
+			continue
+		}
+		if rule.Flags != nil {
+			for _, flag := range flags {
+				if !slices.Contains(rule.Flags, flag) {
+					return deny("flag " + flag + " is not allowed")
+				}
+			}
+		}
+		if rule.Destructive && strings.TrimSpace(confirm) != strings.Join(ruleWords, " ") {
+			decision.ConfirmHeader = confirmHeader + ": " + strings.Join(ruleWords, " ")
+			return deny("destructive command requires confirmation header")
+		}
+		decision.Allowed = true
+		return decision
+	}
+	return deny("command is not allowed")
+}
+
+// splitLpacArgs 拆分子命令和参数，子命令为第一个参数之前的部分
+func splitLpacArgs(args []string) (words []string, flags []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			for _, flag := range args[i:] {
+				if strings.HasPrefix(flag, "-") {
+					flags = append(flags, flag)
+				}
+			}
+			return
+		}
+		// 子命令最多两级，之后是位置参数，例如 profile enable {iccid}
+		if i < 2 {
+			words = append(words, arg)
+		}
+	}
+	return
+}
@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+type progressStage struct {
+	Name        string
+	Description string
+	// Notify 是否在设备上弹出提示
+	Notify bool
+}
+
+// lpac profile download 依次输出的阶段
+var downloadStages = []progressStage{
+	{"es10b_get_euicc_challenge_and_info", "Reading eSIM info", false},
+	{"es9p_initiate_authentication", "Connecting to SM-DP+", true},
+	{"es10b_authenticate_server", "Authenticating SM-DP+", false},
+	{"es9p_authenticate_client", "Authenticating eSIM", false},
+	{"es8p_meatadata_parse", "Reading profile metadata", false},
+	{"es10b_prepare_download", "Preparing download", false},
+	{"es9p_get_bound_profile_package", "Downloading profile", true},
+	{"es10b_load_bound_profile_package", "Installing profile", true},
+}
+
+// lpac notification process 输出的阶段
+var notificationStages = []progressStage{
+	{"es10b_retrieve_notifications_list", "Reading notification", false},
+	{"es9p_handle_notification", "Sending notification", false},
+	{"es10b_remove_notification_from_list", "Removing notification", false},
+}
+
+type ProgressEvent struct {
+	Stage       string `json:"stage"`
+	Description string `json:"description"`
+	Step        int    `json:"step,omitempty"`
+	Total       int    `json:"total,omitempty"`
+	Notify      bool   `json:"-"`
+}
+
+// String 设备上显示的进度提示，例如 Downloading profile (7/8)
+func (e *ProgressEvent) String() string {
+	if e.Total == 0 {
+		return e.Description
+	}
+	return fmt.Sprintf("%s (%d/%d)", e.Description, e.Step, e.Total)
+}
+
+// ProgressReporter 由需要在设备上显示进度的工作模式实现
+type ProgressReporter interface {
+	OnProgress(client *RLPAClient, event *ProgressEvent)
+}
+
+func NewProgressEvent(data *Payload) *ProgressEvent {
+	event := &ProgressEvent{Stage: data.Message, Description: data.Message}
+	for _, stages := range [][]progressStage{downloadStages, notificationStages} {
+		for i, stage := range stages {
+			if stage.Name == data.Message {
+				event.Description = stage.Description
+				event.Step = i + 1
+				event.Total = len(stages)
+				event.Notify = stage.Notify
+				return event
+			}
+		}
+	}
+	return event
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProvisionDownload     = "download"
+	ProvisionEnable       = "enable"
+	ProvisionNickname     = "nickname"
+	ProvisionNotification = "notification"
+
+	ProvisionQueued    = "queued"
+	ProvisionRunning   = "running"
+	ProvisionSucceeded = "succeeded"
+	ProvisionFailed    = "failed"
+)
+
+var (
+	eidRegexp   = regexp.MustCompile(`^[0-9]{32}$`)
+	iccidRegexp = regexp.MustCompile(`^[0-9]{18,19}[0-9F]?$`)
+)
+
+// ProvisionOperation 为指定 EID 预先排队的操作，卡片连接时执行
+type ProvisionOperation struct {
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	ActivationCode string     `json:"activation_code,omitempty"`
+	ConfirmCode    string     `json:"confirmation_code,omitempty"`
+	ICCID          string     `json:"iccid,omitempty"`
+	Nickname       string     `json:"nickname,omitempty"`
+	Status         string     `json:"status"`
+	Result         string     `json:"result,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	// owner 正在执行该操作的连接序号
+	owner uint64
+}
+
+func (op *ProvisionOperation) Validate() error {
+	switch op.Type {
+	case ProvisionDownload:
+		code, _ := CompleteActivationCode(op.ActivationCode)
+		ac, err := ParseActivationCode(code)
+		if err != nil {
+			return err
+		}
+		if ac.ConfirmCodeRequired && op.ConfirmCode == "" {
+			return errors.New("confirmation code required")
+		}
+		op.ActivationCode = ac.String()
+	case ProvisionEnable:
+		if !iccidRegexp.MatchString(op.ICCID) {
+			return errors.New("invalid iccid")
+		}
+	case ProvisionNickname:
+		if !iccidRegexp.MatchString(op.ICCID) {
+			return errors.New("invalid iccid")
+		}
+		// SGP.22 profileNickname 最长 64 字节
+		if len(op.Nickname) > 64 {
+			return errors.New("nickname longer than 64 bytes")
+		}
+	case ProvisionNotification:
+	default:
+		return errors.New("unknown operation type: " + op.Type)
+	}
+	return nil
+}
+
+type ProvisioningStore struct {
+	mu  sync.Mutex
+	ops map[string][]*ProvisionOperation
+}
+
+var Provisioning = NewProvisioningStore()
+
+func NewProvisioningStore() *ProvisioningStore {
+	return &ProvisioningStore{ops: make(map[string][]*ProvisionOperation)}
+}
+
+// NormalizeEID 去掉 EID 中的空白，例如按 4 位分组书写的 EID
+func NormalizeEID(eid string) (string, error) {
+	eid = strings.Join(strings.Fields(eid), "")
+	if !eidRegexp.MatchString(eid) {
+		return "", errors.New("invalid eid")
+	}
+	return eid, nil
+}
+
+// Enqueue 校验并添加操作，返回保存后的副本
+func (s *ProvisioningStore) Enqueue(eid string, op ProvisionOperation) (ProvisionOperation, error) {
+	if err := op.Validate(); err != nil {
+		return op, err
+	}
+	id, err := randomString("0123456789abcdef", 8)
+	if err != nil {
+		return op, err
+	}
+	op.ID = id
+	op.Status = ProvisionQueued
+	op.Result = ""
+	op.CreatedAt = time.Now()
+	op.FinishedAt = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops[eid] = append(s.ops[eid], &op)
+	return op, nil
+}
+
+// HasQueued 是否存在任意待执行的操作，用于跳过不必要的 chip info
+// 连接时还不知道 EID，只要有任意 EID 的待执行操作，所有连接的设备都会多执行一次 chip info
+func (s *ProvisioningStore) HasQueued() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ops := range s.ops {
+		for _, op := range ops {
+			if op.Status == ProvisionQueued {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claim 将 EID 下待执行的操作标记为执行中并返回副本，同一 EID 的多个连接不会重复执行
+func (s *ProvisioningStore) Claim(eid string, owner uint64) []ProvisionOperation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed []ProvisionOperation
+	for _, op := range s.ops[eid] {
+		if op.Status == ProvisionQueued {
+			op.Status = ProvisionRunning
+			op.owner = owner
+			claimed = append(claimed, *op)
+		}
+	}
+	return claimed
+}
+
+// Release 连接断开时把还没有执行完的操作放回队列
+func (s *ProvisioningStore) Release(owner uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ops := range s.ops {
+		for _, op := range ops {
+			if op.Status == ProvisionRunning && op.owner == owner {
+				op.Status = ProvisionQueued
+				op.owner = 0
+			}
+		}
+	}
+}
+
+func (s *ProvisioningStore) List(eid string) []ProvisionOperation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ProvisionOperation, 0, len(s.ops[eid]))
+	for _, op := range s.ops[eid] {
+		list = append(list, *op)
+	}
+	return list
+}
+
+// Record 记录操作的执行结果
+func (s *ProvisioningStore) Record(eid, id string, succeeded bool, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range s.ops[eid] {
+		if op.ID == id {
+			op.owner = 0
+			op.Status = ProvisionFailed
+			if succeeded {
+				op.Status = ProvisionSucceeded
+			}
+			op.Result = result
+			now := time.Now()
+			op.FinishedAt = &now
+			return
+		}
+	}
+}
+
+// Remove 删除操作，不存在时返回 false
+func (s *ProvisioningStore) Remove(eid, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := s.ops[eid]
+	for i, op := range ops {
+		if op.ID == id {
+			s.ops[eid] = append(ops[:i:i], ops[i+1:]...)
+			if len(s.ops[eid]) == 0 {
+				delete(s.ops, eid)
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol v1/v2，负载均衡转发连接时在数据前附加客户端的真实地址
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1MaxLength = 107
+	proxyV2HeaderLen = 16
+)
+
+var ErrProxyHeaderMissing = errors.New("missing proxy protocol header")
+
+// proxyConn 解析过 PROXY 头的连接，RemoteAddr 返回客户端的真实地址
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// trustedProxy 连接是否来自配置中信任的负载均衡
+func trustedProxy(addr net.Addr, trusted []netip.Prefix) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxy 读取 PROXY 头并返回携带真实地址的连接，超时或格式错误时返回错误
+// LOCAL 命令和 UNKNOWN 协议沿用负载均衡的地址
+func acceptProxy(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	reader := bufio.NewReader(conn)
+	// 最短的 v1 头 "PROXY UNKNOWN\r\n" 有 15 字节，按 v2 签名的长度读取不会多等数据
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	switch {
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err = readProxyV1(reader)
+	case bytes.Equal(start, proxyV2Signature):
+		remote, err = readProxyV2(reader)
+	default:
+		return nil, ErrProxyHeaderMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyV1 解析文本格式：PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("proxy protocol v1 header too long")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid proxy protocol v1 header")
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, errors.New("invalid proxy protocol v1 source address")
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid proxy protocol v1 source port")
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 解析二进制格式，只使用 TCP over IPv4/IPv6 的源地址，其余部分跳过
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported proxy protocol version")
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	switch {
+	case command == 0x0:
+		// LOCAL，负载均衡自己的健康检查
+		return nil, nil
+	case command != 0x1:
+		return nil, errors.New("unsupported proxy protocol command")
+	}
+	switch family {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errors.New("proxy protocol v2 address too short")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errors.New("proxy protocol v2 address too short")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))), nil
+	default:
+		return nil, nil
+	}
+}
+
+// parseProxyTrusted 解析信任的负载均衡地址，支持单个 IP 和 CIDR
+func parseProxyTrusted(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var reloadHooks struct {
+	mu    sync.Mutex
+	hooks []reloadHook
+}
+
+type reloadHook struct {
+	name string
+	fn   func() error
+}
+
+// OnReload 注册收到 SIGHUP 时执行的操作
+func OnReload(name string, fn func() error) {
+	reloadHooks.mu.Lock()
+	defer reloadHooks.mu.Unlock()
+	reloadHooks.hooks = append(reloadHooks.hooks, reloadHook{name: name, fn: fn})
+}
+
+// Reload 依次执行注册的操作，某一项失败不影响其他项
+func Reload() {
+	reloadHooks.mu.Lock()
+	hooks := append([]reloadHook{}, reloadHooks.hooks...)
+	reloadHooks.mu.Unlock()
+	for _, hook := range hooks {
+		if err := hook.fn(); err != nil {
+			slog.Error("Failed to reload "+hook.name, "error", err)
+			continue
+		}
+		slog.Info("Reloaded " + hook.name)
+	}
+}
+
+// WatchReload 收到 SIGHUP 时调用 Reload
+func WatchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		Reload()
+	}
+}
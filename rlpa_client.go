@@ -8,83 +8,129 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"math/rand"
 	"net"
 	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const keepaliveDuration time.Duration = 60 * time.Second
-
-// 为了避免混淆，剔除 0, O, o, 1, l, I, 2, Z, B, 8
-const letters = "abcdefghijkmnpqrstuvwxyzACDEFGHJKLMNPQRSTUVWXY345679"
-const digits = "0123456789"
+const (
+	lpacMaxLineSize   = 4 << 20
+	lpacMaxStderrSize = 64 << 10
+)
 
-var Credentials map[string]string
+// clientSerial 连接序号，用于在管理 API 中指定连接
+var clientSerial atomic.Uint64
 
 type RLPAClient struct {
-	IsClosing       bool
-	ID              string
-	WorkMode        RLPAWorkMode
-	Socket          net.Conn
-	Packet          RLPAPacket
-	CMD             *exec.Cmd
-	LpacStdin       io.WriteCloser
-	LpacStdout      io.ReadCloser
-	LpacStderr      io.ReadCloser
-	ResponseWaiting bool
-	ResponseChan    chan []byte
-	APILocked       bool
-	KeepAliveTimer  *time.Timer
-}
-
-var APIClients []*RLPAClient
+	Serial uint64
+	Socket net.Conn
+	Packet RLPAPacket
+	// Jobs 在 NewRLPAClient 中创建，之后不再修改
+	Jobs        *JobQueue
+	ConnectedAt time.Time
+	lease       leaseState
+	closing     atomic.Bool
+	done        chan struct{}
+	writeMu     sync.Mutex
+
+	// mu 保护以下字段，socket、lpac 和 HTTP 的 goroutine 都会访问
+	mu        sync.Mutex
+	id        string
+	role      string
+	workMode  RLPAWorkMode
+	lpac      *LpacProcess
+	lpacStdin io.WriteCloser
+	// 最近一次 chip info 和 profile list 的结果
+	chipInfo *LpacChipInfo
+	profiles []LpacProfile
+
+	Events       *EventHub
+	APDUSent     atomic.Int64
+	APDUReceived atomic.Int64
+	// 最近一次发送 APDU 的时间，用于统计往返延迟
+	apduSentAt atomic.Int64
+}
 
 func NewRLPAClient(conn net.Conn) *RLPAClient {
-	return &RLPAClient{
-		Socket:       conn,
-		Packet:       NewRLPAPacket(0x00, []byte{}),
-		ResponseChan: make(chan []byte),
-	}
+	c := &RLPAClient{
+		Serial:      clientSerial.Add(1),
+		Socket:      conn,
+		Packet:      NewRLPAPacket(0x00, []byte{}),
+		Events:      NewEventHub(),
+		ConnectedAt: time.Now(),
+		done:        make(chan struct{}),
+	}
+	// 在创建时设置，之后只读，HTTP 的 goroutine 访问时不需要加锁
+	c.Jobs = NewJobQueue(c)
+	return c
 }
 
-func (c *RLPAClient) GenCredential() string {
-	for {
-		id := generateID(4)
-		if _, exists := Credentials[id]; !exists {
-			passwd := generatePasswd(4)
-			Credentials[id] = passwd
-			c.ID = id
-			return passwd
-		}
-	}
+// ID 返回 ManageID，凭据被重新生成后会改变
+func (c *RLPAClient) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
 }
 
-// generateID 生成 n 位随机字符
-func generateID(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
+func (c *RLPAClient) setID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id = id
 }
 
-// generatePasswd 生成 n 位随机数字
-func generatePasswd(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = digits[rand.Intn(len(digits))]
-	}
-	return string(b)
+// Role 返回命令策略中的角色
+func (c *RLPAClient) Role() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
 }
 
-func FindClient(id string) (*RLPAClient, error) {
-	for _, c := range APIClients {
-		if c.ID == id {
-			return c, nil
-		}
-	}
-	return nil, errors.New("client not found")
+// assignRole 按命令策略和设备地址为连接指定角色
+func (c *RLPAClient) assignRole() {
+	role := CommandPolicy.RoleFor(hostOf(c.Socket.RemoteAddr()))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+// WorkMode 返回当前工作模式，未选择时为 nil
+func (c *RLPAClient) WorkMode() RLPAWorkMode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.workMode
+}
+
+func (c *RLPAClient) SetWorkMode(m RLPAWorkMode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workMode = m
+}
+
+// Lpac 返回最近一次启动的 lpac 进程
+func (c *RLPAClient) Lpac() *LpacProcess {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lpac
+}
+
+// CachedChip 返回缓存的 chip info 和 profile list 结果
+func (c *RLPAClient) CachedChip() (*LpacChipInfo, []LpacProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chipInfo, c.profiles
+}
+
+// Closing 连接是否正在关闭
+func (c *RLPAClient) Closing() bool {
+	return c.closing.Load()
+}
+
+// Done 在连接关闭时关闭
+func (c *RLPAClient) Done() <-chan struct{} {
+	return c.done
 }
 
 func (c *RLPAClient) RemoteAddr() string {
@@ -97,7 +143,9 @@ func (c *RLPAClient) SendRLPAPacket(tag uint8, value []byte) error {
 	if err != nil {
 		return err
 	}
+	c.writeMu.Lock()
 	_, err = c.Socket.Write(packetData)
+	c.writeMu.Unlock()
 	c.DebugLog(fmt.Sprint("Send packet: ", packetData))
 	if err != nil {
 		return err
@@ -110,6 +158,7 @@ func (c *RLPAClient) MessageBox(msg string) error {
 	if err != nil {
 		return err
 	}
+	c.Events.Publish(EventMessageBox, MessageBoxEvent{Text: msg})
 	return nil
 }
 
@@ -131,6 +180,11 @@ func (c *RLPAClient) UnlockAPDU() error {
 
 func (c *RLPAClient) ProcessPacket() error {
 	if c.Packet.Tag == TagApdu {
+		c.APDUReceived.Add(1)
+		if sentAt := c.apduSentAt.Swap(0); sentAt != 0 {
+			Metrics.APDURTT.Observe(time.Since(time.Unix(0, sentAt)))
+		}
+		c.publishAPDUCount()
 		jsonData, err := json.Marshal(
 			map[string]interface{}{
 				"type": "apdu",
@@ -152,21 +206,22 @@ func (c *RLPAClient) ProcessPacket() error {
 	}
 
 	// 已经在工作模式中
-	if c.WorkMode != nil {
+	if c.WorkMode() != nil {
 		return nil
 	}
 
+	var mode RLPAWorkMode
 	switch c.Packet.Tag {
 	case TagManagement:
-		c.WorkMode = new(ShellWorkMode)
+		mode = new(ShellWorkMode)
 		c.InfoLog("Enter ShellMode")
 		break
 	case TagProcessNotification:
-		c.WorkMode = new(ProcessNotificationWorkMode)
+		mode = new(ProcessNotificationWorkMode)
 		c.InfoLog("Enter Process Notification Mode")
 		break
 	case TagDownloadProfile:
-		c.WorkMode = new(DownloadWorkMode)
+		mode = &DownloadWorkMode{Input: string(c.Packet.Value)}
 		c.InfoLog("Enter Download Profile Mode")
 		break
 	default:
@@ -177,52 +232,36 @@ func (c *RLPAClient) ProcessPacket() error {
 		c.ErrLog("unimplemented mode")
 		return errors.New("unimplemented command")
 	}
-	if c.WorkMode == nil {
+	if mode == nil {
 		return errors.New("no workmode selected")
 	}
+	// 存在预先排队的操作时，先读取 EID 执行队列
+	if CFG().Features.Provisioning && Provisioning.HasQueued() {
+		mode = &ProvisionWorkMode{Next: mode}
+		c.InfoLog("Enter Provision Mode")
+	}
 
-	c.WorkMode.Start(c)
+	c.SetWorkMode(mode)
+	c.Events.Publish(EventLifecycle, LifecycleEvent{State: "workmode", WorkMode: WorkModeName(mode)})
+	mode.Start(c)
 	return nil
 }
 
 func (c *RLPAClient) Close(result int) {
-	if c.IsClosing {
+	if !c.closing.CompareAndSwap(false, true) {
 		return
 	}
-	c.IsClosing = true
-	_, errFound := FindClient(c.ID)
-	if errFound == nil {
-		// 如果连接了 API，移除凭据
-		delete(Credentials, c.ID)
-		var newAPIClients []*RLPAClient
-		for _, client := range APIClients {
-			if c.ID != client.ID {
-				newAPIClients = append(newAPIClients, client)
-			}
-		}
-		APIClients = newAPIClients
-	}
-	if c.CMD != nil {
-		if c.CMD.ProcessState == nil {
-			err := c.CMD.Process.Kill()
-			if err != nil {
-				c.ErrLog("Failed to kill lpac process")
-			}
+	Metrics.SessionsClosed.Inc(closeResultNames[result])
+	// 如果连接了 API，移除凭据
+	Sessions.Remove(c)
+	if proc := c.Lpac(); proc != nil && proc.Running() {
+		err := proc.Cmd.Process.Kill()
+		if err != nil {
+			c.ErrLog("Failed to kill lpac process")
 		}
 	}
-	// if c.ResponseWaiting {
-	// 	switch result {
-	// 	case ResultFinished:
-	// 		c.ResponseChan <- []byte("OK")
-	// 		break
-	// 	case ResultClientDisconnect:
-	// 		c.ResponseChan <- []byte("client disconnected")
-	// 		break
-	// 	case ResultError:
-	// 		c.ResponseChan <- []byte("lpac error")
-	// 		break
-	// 	}
-	// }
+	c.Jobs.Close()
+	c.DisconnectAPI()
 
 	err := c.UnlockAPDU()
 	if err != nil {
@@ -230,68 +269,186 @@ func (c *RLPAClient) Close(result int) {
 	}
 	packet := NewRLPAPacket(TagClose, []byte{})
 	packetData, _ := packet.Pack()
+	c.writeMu.Lock()
 	_, err2 := c.Socket.Write(packetData)
+	c.writeMu.Unlock()
 	if err2 != nil {
 		c.ErrLog("Failed to send socket packet: " + string(packetData))
 	}
 
+	c.Events.Publish(EventLifecycle, LifecycleEvent{State: "closed", Result: &result})
+	c.Events.Close()
+
 	err3 := c.Socket.Close()
 	if err3 != nil {
 		c.ErrLog("Failed to close socket")
 	}
+	close(c.done)
 	c.InfoLog("Disconnected")
-	c.Socket = nil
 }
 
-func (c *RLPAClient) processOpenLpac(args ...string) error {
-	// TODO
+// LpacProcess 一次 lpac 运行，Exited 关闭后 Result、Stderr、ExitCode 可读
+type LpacProcess struct {
+	Args      []string
+	Cmd       *exec.Cmd
+	StartedAt time.Time
+	Exited    chan struct{}
+	Result    *Payload
+	Stderr    string
+	ExitCode  int
+	timer     *time.Timer
+}
+
+func (p *LpacProcess) Running() bool {
+	select {
+	case <-p.Exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// processOpenLpac 启动 lpac 并返回进程，进程结束时关闭 Exited
+func (c *RLPAClient) processOpenLpac(args ...string) (*LpacProcess, error) {
 	err := c.LockAPDU()
 	if err != nil {
-		return err
-	}
-	c.CMD = exec.Command(CFG.LpacPath, args...)
-	c.CMD.Env = []string{
-		"LPAC_APDU=stdio",
+		return nil, err
 	}
+	cfg := CFG()
+	cmd := exec.Command(cfg.LpacPath, args...)
+	// LPAC_APDU 放在最后，不允许配置覆盖
+	cmd.Env = append(append([]string{}, cfg.LpacEnv...), "LPAC_APDU=stdio")
 	// 连接 stdio
-	c.LpacStdin, err = c.CMD.StdinPipe()
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.LpacStdout, err = c.CMD.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.LpacStderr, err = c.CMD.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = c.CMD.Start()
+	err = cmd.Start()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	Metrics.LpacRunning.Add(1)
+	proc := &LpacProcess{
+		Args:      args,
+		Cmd:       cmd,
+		StartedAt: time.Now(),
+		Exited:    make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.lpac = proc
+	c.lpacStdin = stdin
+	c.mu.Unlock()
+	c.Events.Publish(EventLifecycle, LifecycleEvent{State: "lpac_started", Args: args})
+	if cfg.LpacTimeout > 0 {
+		// 超时后结束 lpac，避免卡住的进程一直占用连接
+		proc.timer = time.AfterFunc(cfg.LpacTimeout, func() {
+			c.ErrLog(fmt.Sprint("lpac timed out after ", cfg.LpacTimeout))
+			_ = cmd.Process.Kill()
+		})
 	}
+	go c.waitLpac(proc, stdout, stderr)
+	return proc, nil
+}
+
+// waitLpac 读取 lpac 输出直到进程退出，然后解锁 APDU 并通知工作模式
+// 必须先读完管道再 Wait，否则可能丢失输出
+func (c *RLPAClient) waitLpac(proc *LpacProcess, stdout, stderr io.Reader) {
+	stderrDone := make(chan string)
 	go func() {
-		_ = c.CMD.Wait()
-		if !c.IsClosing {
-			err := c.UnlockAPDU()
-			if err != nil {
-				c.Close(ResultError)
-			}
-		}
+		stderrDone <- c.OnLpacStderr(stderr)
 	}()
-	go func() {
-		errStdout := c.OnLpacStdout()
-		if errStdout != nil {
-			c.Close(ResultError)
+	result, errStdout := c.OnLpacStdout(stdout)
+	if errStdout != nil {
+		// 不再读取 stdout 时结束进程，避免 lpac 阻塞在写入上
+		_ = proc.Cmd.Process.Kill()
+	}
+	proc.Stderr = <-stderrDone
+	_ = proc.Cmd.Wait()
+	if proc.timer != nil {
+		proc.timer.Stop()
+	}
+	proc.Result = result
+	proc.ExitCode = proc.Cmd.ProcessState.ExitCode()
+	Metrics.LpacRunning.Add(-1)
+	observeLpacResult(proc, result)
+	// 先解锁 APDU 并缓存结果再通知等待者，等待者随后发起的下一次运行不会与解锁交错
+	var errUnlock error
+	if errStdout == nil && !c.Closing() {
+		errUnlock = c.UnlockAPDU()
+		if errUnlock == nil && result != nil {
+			c.cacheLpacResult(proc.Args, result)
 		}
-	}()
-	go c.OnLpacStderr()
-	return nil
+	}
+	close(proc.Exited)
+	c.Events.Publish(EventLifecycle, LifecycleEvent{State: "lpac_exited", ExitCode: &proc.ExitCode})
+
+	if errStdout != nil {
+		c.ErrLog("lpac stdout: " + errStdout.Error())
+		c.Close(ResultError)
+		return
+	}
+	if c.Closing() {
+		return
+	}
+	if errUnlock != nil {
+		c.Close(ResultError)
+		return
+	}
+	if result == nil {
+		c.ErrLog(fmt.Sprint("lpac exited without result, exit code ", proc.ExitCode))
+	}
+	c.WorkMode().OnProcessFinished(c, result)
+}
+
+// cacheLpacResult 保存 chip info 和 profile list 的结果供 info API 使用，修改 profile 后清除列表
+func (c *RLPAClient) cacheLpacResult(args []string, result *Payload) {
+	if len(args) < 2 {
+		return
+	}
+	command := args[0] + " " + args[1]
+	// 修改 profile 的命令执行后缓存的列表已过期，失败时也可能已经部分生效
+	switch command {
+	case "profile enable", "profile disable", "profile delete", "profile nickname", "profile download", "chip purge":
+		c.mu.Lock()
+		c.profiles = nil
+		c.mu.Unlock()
+		return
+	}
+	if result.Code != 0 {
+		return
+	}
+	switch command {
+	case "chip info":
+		var info LpacChipInfo
+		if json.Unmarshal(result.Data, &info) == nil {
+			c.mu.Lock()
+			c.chipInfo = &info
+			c.mu.Unlock()
+		}
+	case "profile list":
+		var profiles []LpacProfile
+		if json.Unmarshal(result.Data, &profiles) == nil {
+			c.mu.Lock()
+			c.profiles = profiles
+			c.mu.Unlock()
+		}
+	}
 }
 
-func (c *RLPAClient) OnLpacStdout() error {
-	scanner := bufio.NewScanner(c.LpacStdout)
+// OnLpacStdout 处理 lpac 的 APDU 请求，返回 lpa 结果
+func (c *RLPAClient) OnLpacStdout(stdout io.Reader) (*Payload, error) {
+	var result *Payload
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), lpacMaxLineSize)
 	// 当 lpac 进程结束，管道会写入 EOF 自动关闭，函数退出
 	for scanner.Scan() {
 		line := scanner.Bytes()
@@ -299,7 +456,7 @@ func (c *RLPAClient) OnLpacStdout() error {
 		var req Request
 		err := json.Unmarshal(line, &req)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		switch req.Type {
 		case "apdu":
@@ -312,11 +469,11 @@ func (c *RLPAClient) OnLpacStdout() error {
 					},
 				})
 				if errMarshal != nil {
-					return errMarshal
+					return nil, errMarshal
 				}
 				errWrite := c.WriteLpacStdin(jsonData)
 				if errWrite != nil {
-					return errWrite
+					return nil, errWrite
 				}
 				c.DebugLogWriteLpacStdin(jsonData)
 			case "logic_channel_open":
@@ -327,77 +484,80 @@ func (c *RLPAClient) OnLpacStdout() error {
 					},
 				})
 				if errMarshal != nil {
-					return errMarshal
+					return nil, errMarshal
 				}
 				errWrite := c.WriteLpacStdin(jsonData)
 				if errWrite != nil {
-					return errWrite
+					return nil, errWrite
 				}
 				c.DebugLogWriteLpacStdin(jsonData)
 			case "transmit":
 				hexBytes, errHexDecode := hex.DecodeString(req.Payload.Param)
 				if errHexDecode != nil {
-					return errHexDecode
+					return nil, errHexDecode
 				}
+				c.apduSentAt.Store(time.Now().UnixNano())
 				errSendPacket := c.SendRLPAPacket(TagApdu, hexBytes)
-				if errHexDecode != nil {
-					return errSendPacket
+				if errSendPacket != nil {
+					return nil, errSendPacket
 				}
+				c.APDUSent.Add(1)
+				c.publishAPDUCount()
 			}
 		case "lpa":
 			c.DebugLog("run lpac finished")
-			c.WorkMode.OnProcessFinished(c, &req.Payload)
-			return nil
+			result = &req.Payload
+			c.Events.Publish(EventResult, ShellResult{Payload: result, Error: DecodeLpacError(result)})
+		case "progress":
+			event := NewProgressEvent(&req.Payload)
+			c.DebugLog("lpac progress: " + event.Stage)
+			c.Events.Publish(EventProgress, event)
+			if reporter, ok := c.WorkMode().(ProgressReporter); ok {
+				reporter.OnProgress(c, event)
+			}
 		default:
-			// 一般是 type: process
 			break
 		}
 	}
-	return nil
+	return result, scanner.Err()
 }
 
-func (c *RLPAClient) OnLpacStderr() {
-	scanner := bufio.NewScanner(c.LpacStderr)
+// OnLpacStderr 记录 lpac 的错误输出并返回全部内容
+func (c *RLPAClient) OnLpacStderr(stderr io.Reader) string {
+	var buf strings.Builder
+	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
 		line := scanner.Text()
-		// if c.ResponseWaiting {
-		// 	c.ResponseChan <- line
-		// }
 		c.ErrLog(line)
-		c.Close(ResultError)
-		return
+		if buf.Len() < lpacMaxStderrSize {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
 	}
+	return buf.String()
+}
+
+func (c *RLPAClient) publishAPDUCount() {
+	c.Events.Publish(EventAPDU, APDUEvent{
+		Sent:     c.APDUSent.Load(),
+		Received: c.APDUReceived.Load(),
+	})
 }
 
 func (c *RLPAClient) WriteLpacStdin(data []byte) error {
-	if c.LpacStdin == nil {
+	c.mu.Lock()
+	stdin := c.lpacStdin
+	c.mu.Unlock()
+	if stdin == nil {
 		return nil
 	}
-	_, err := c.LpacStdin.Write(append(data, '\n'))
+	_, err := stdin.Write(append(data, '\n'))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *RLPAClient) StartOrResetTimer() {
-	if c.KeepAliveTimer == nil {
-		c.KeepAliveTimer = time.AfterFunc(keepaliveDuration, func() {
-			c.DisconnectAPI()
-		})
-	} else {
-		c.KeepAliveTimer.Reset(keepaliveDuration)
-	}
-}
-
-func (c *RLPAClient) DisconnectAPI() {
-	// TODO
-	if c.ResponseWaiting {
-		// c.ResponseChan <- []byte("timeout")
-	}
-	c.APILocked = false
-}
-
 func (c *RLPAClient) DebugLog(msg string) {
 	slog.Debug(msg, "client", c.RemoteAddr())
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// SessionRegistry 保存所有 RLPA 连接以及进入 shell 模式的连接的凭据，可在多个 goroutine 中使用
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	conns    map[uint64]*RLPAClient
+	sessions map[string]*sessionEntry
+	onClose  []func(c *RLPAClient)
+}
+
+type sessionEntry struct {
+	client *RLPAClient
+	passwd credentialHash
+}
+
+// dummyCredential 用于 ManageID 不存在时的比较，使校验耗时一致
+var dummyCredential, _ = hashCredential("")
+
+var Sessions = NewSessionRegistry()
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		conns:    make(map[uint64]*RLPAClient),
+		sessions: make(map[string]*sessionEntry),
+	}
+}
+
+// Add 登记新的连接
+func (s *SessionRegistry) Add(c *RLPAClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c.Serial] = c
+}
+
+// Get 按连接序号查找连接
+func (s *SessionRegistry) Get(serial uint64) (*RLPAClient, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.conns[serial]
+	return c, ok
+}
+
+// Register 为连接生成不重复的 ManageID 和密码并登记，返回明文密码，只保存哈希
+func (s *SessionRegistry) Register(c *RLPAClient) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registerLocked(c)
+}
+
+// Rotate 作废连接当前的凭据并生成新的 ManageID 和密码
+func (s *SessionRegistry) Rotate(c *RLPAClient) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.sessions[c.ID()]; ok && entry.client == c {
+		delete(s.sessions, c.ID())
+	}
+	return s.registerLocked(c)
+}
+
+func (s *SessionRegistry) registerLocked(c *RLPAClient) (string, error) {
+	passwd, err := generatePasswd()
+	if err != nil {
+		return "", err
+	}
+	hash, err := hashCredential(passwd)
+	if err != nil {
+		return "", err
+	}
+	for {
+		id, err := generateID()
+		if err != nil {
+			return "", err
+		}
+		if _, exists := s.sessions[id]; exists {
+			continue
+		}
+		s.sessions[id] = &sessionEntry{client: c, passwd: hash}
+		c.setID(id)
+		return passwd, nil
+	}
+}
+
+// Find 按 ManageID 查找连接
+func (s *SessionRegistry) Find(id string) (*RLPAClient, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.client, true
+}
+
+// Verify 校验 ManageID 和密码
+func (s *SessionRegistry) Verify(id, passwd string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.sessions[id]
+	if !ok {
+		dummyCredential.Verify(passwd)
+		return false
+	}
+	return entry.passwd.Verify(passwd)
+}
+
+// Remove 移除连接和凭据并通知 OnClose 注册的回调，连接未登记时返回 false
+func (s *SessionRegistry) Remove(c *RLPAClient) bool {
+	s.mu.Lock()
+	if entry, ok := s.sessions[c.ID()]; ok && entry.client == c {
+		delete(s.sessions, c.ID())
+	}
+	if _, ok := s.conns[c.Serial]; !ok {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.conns, c.Serial)
+	callbacks := append([]func(*RLPAClient){}, s.onClose...)
+	s.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(c)
+	}
+	return true
+}
+
+// Snapshot 返回当前所有连接的副本，按连接顺序排列，遍历期间不持有锁
+func (s *SessionRegistry) Snapshot() []*RLPAClient {
+	s.mu.RLock()
+	clients := make([]*RLPAClient, 0, len(s.conns))
+	for _, c := range s.conns {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Serial < clients[j].Serial })
+	return clients
+}
+
+// Len 返回当前连接数
+func (s *SessionRegistry) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.conns)
+}
+
+// OnClose 注册连接移除时的回调，回调在不持有锁的情况下执行
+func (s *SessionRegistry) OnClose(fn func(c *RLPAClient)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onClose = append(s.onClose, fn)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestClient(t *testing.T) *RLPAClient {
+	t.Helper()
+	server, client := net.Pipe()
+	// 读走服务端写入的数据包，否则 net.Pipe 的写入会阻塞
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return NewRLPAClient(server)
+}
+
+func TestSessionRegistryConcurrent(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	const workers = 300
+	registry := NewSessionRegistry()
+	var closed atomic.Int64
+	registry.OnClose(func(c *RLPAClient) {
+		closed.Add(1)
+	})
+	clients := make([]*RLPAClient, workers)
+	for i := range clients {
+		clients[i] = newTestClient(t)
+	}
+
+	// 读取方在增删期间持续遍历
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snapshot := registry.Snapshot()
+				if !sort.SliceIsSorted(snapshot, func(i, j int) bool { return snapshot[i].Serial < snapshot[j].Serial }) {
+					t.Error("snapshot is not ordered by serial")
+					return
+				}
+				for _, c := range snapshot {
+					registry.Find(c.ID())
+				}
+				registry.Len()
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i, c := range clients {
+		writers.Add(1)
+		go func(i int, c *RLPAClient) {
+			defer writers.Done()
+			registry.Add(c)
+			passwd, err := registry.Register(c)
+			if err != nil {
+				t.Errorf("Register: %v", err)
+				return
+			}
+			if i%3 == 0 {
+				if passwd, err = registry.Rotate(c); err != nil {
+					t.Errorf("Rotate: %v", err)
+					return
+				}
+			}
+			id := c.ID()
+			if found, ok := registry.Find(id); !ok || found != c {
+				t.Errorf("Find(%q) did not return the registered client", id)
+			}
+			if got, ok := registry.Get(c.Serial); !ok || got != c {
+				t.Errorf("Get(%d) did not return the added client", c.Serial)
+			}
+			if !registry.Verify(id, passwd) {
+				t.Errorf("Verify(%q) rejected the issued password", id)
+			}
+			if registry.Verify(id, passwd+"x") {
+				t.Errorf("Verify(%q) accepted a wrong password", id)
+			}
+			if !registry.Remove(c) {
+				t.Errorf("Remove(%d) = false for an added client", c.Serial)
+			}
+			if registry.Remove(c) {
+				t.Errorf("second Remove(%d) = true", c.Serial)
+			}
+			if _, ok := registry.Find(id); ok {
+				t.Errorf("Find(%q) still returns a removed client", id)
+			}
+		}(i, c)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	if n := registry.Len(); n != 0 {
+		t.Errorf("Len() = %d after removing all clients, want 0", n)
+	}
+	if n := closed.Load(); n != workers {
+		t.Errorf("OnClose called %d times, want %d", n, workers)
+	}
+}
+
+func TestSessionRegistryRotate(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	registry := NewSessionRegistry()
+	c := newTestClient(t)
+	registry.Add(c)
+	oldPasswd, err := registry.Register(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := c.ID()
+	newPasswd, err := registry.Rotate(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID() == oldID {
+		t.Skip("rotated to the same ManageID by chance")
+	}
+	if _, ok := registry.Find(oldID); ok {
+		t.Error("old ManageID still resolves after Rotate")
+	}
+	if registry.Verify(oldID, oldPasswd) {
+		t.Error("old credential still verifies after Rotate")
+	}
+	if !registry.Verify(c.ID(), newPasswd) {
+		t.Error("new credential does not verify")
+	}
+}
+
+func TestSessionRegistryRemoveUnknown(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	registry := NewSessionRegistry()
+	called := false
+	registry.OnClose(func(c *RLPAClient) { called = true })
+	if registry.Remove(newTestClient(t)) {
+		t.Error("Remove of a client that was never added = true")
+	}
+	if called {
+		t.Error("OnClose called for a client that was never added")
+	}
+}
+
+func TestRLPAClientConcurrent(t *testing.T) {
+	currentConfig.Store(defaultConfig())
+	c := newTestClient(t)
+	Sessions.Add(c)
+	const workers = 100
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				// 多个客户端争抢租约，续期和释放只对持有者生效
+				token, expires, err := c.AcquireLease()
+				if err != nil {
+					if !errors.Is(err, ErrLeaseHeld) && !errors.Is(err, ErrJobQueueClosed) {
+						t.Errorf("AcquireLease: %v", err)
+					}
+					return
+				}
+				if renewed, err := c.RenewLease(token); err == nil && renewed.Before(expires) {
+					t.Errorf("RenewLease moved expiry back from %v to %v", expires, renewed)
+				}
+				_ = c.ReleaseLease(token)
+			case 1:
+				c.Role()
+				c.ID()
+				c.WorkMode()
+				c.CachedChip()
+				c.LeaseInfo()
+				c.Jobs.Get("missing")
+			case 2:
+				c.assignRole()
+				c.SetWorkMode(&ShellWorkMode{})
+			case 3:
+				// 在其他 goroutine 运行期间关闭连接
+				if i == workers/2+1 {
+					c.Close(ResultFinished)
+				}
+				c.Closing()
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Close(ResultFinished)
+	select {
+	case <-c.Done():
+	default:
+		t.Error("Done() not closed after Close")
+	}
+	if _, err := c.Jobs.Submit([]string{"chip", "info"}); !errors.Is(err, ErrJobQueueClosed) {
+		t.Errorf("Submit after Close error = %v, want ErrJobQueueClosed", err)
+	}
+	if held, _ := c.LeaseInfo(); held {
+		t.Error("lease still held after Close")
+	}
+}
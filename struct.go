@@ -3,11 +3,12 @@ package main
 import "encoding/json"
 
 type Payload struct {
-	Code  int             `json:"code"`
-	Func  string          `json:"func"`
-	Param string          `json:"param"`
-	Ecode int             `json:"ecode"`
-	Data  json.RawMessage `json:"data"`
+	Code    int             `json:"code"`
+	Func    string          `json:"func"`
+	Param   string          `json:"param"`
+	Message string          `json:"message"`
+	Ecode   int             `json:"ecode"`
+	Data    json.RawMessage `json:"data"`
 }
 
 type Request struct {
@@ -29,3 +30,24 @@ type PullInfo struct {
 	ConfirmCode string
 	IMEI        string
 }
+
+type LpacProfile struct {
+	ICCID               string  `json:"iccid"`
+	ISDPAID             string  `json:"isdpAid"`
+	ProfileState        string  `json:"profileState"`
+	ProfileNickname     *string `json:"profileNickname"`
+	ServiceProviderName *string `json:"serviceProviderName"`
+	ProfileName         *string `json:"profileName"`
+	IconType            *string `json:"iconType"`
+	Icon                *string `json:"icon"`
+	ProfileClass        *string `json:"profileClass"`
+}
+
+type LpacChipInfo struct {
+	EID                      string `json:"eidValue"`
+	EuiccConfiguredAddresses struct {
+		DefaultDpAddress *string `json:"defaultDpAddress"`
+		RootDsAddress    *string `json:"rootDsAddress"`
+	} `json:"EuiccConfiguredAddresses"`
+	EUICCInfo2 json.RawMessage `json:"EUICCInfo2"`
+}
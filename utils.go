@@ -1,46 +1,181 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"image"
 	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/big"
+	"net/url"
 	"strings"
+	"unicode"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
 )
 
 func DecodeLpaActivationCode(code string) (info PullInfo, confirmCodeNeeded bool, err error) {
-	// ref: https://www.gsma.com/esim/wp-content/uploads/2020/06/SGP.22-v2.2.2.pdf#page=111
-	err = errors.New("LPA Activation Code format error")
-	code = strings.TrimSpace(code)
-	var ok bool
-	if code, ok = strings.CutPrefix(code, "LPA:"); !ok {
+	ac, err := ParseActivationCode(code)
+	if err != nil {
 		return
 	}
-	switch parts := strings.Split(code, "$"); parts[0] {
-	case "1": // Activation Code Format
-		var codeNeeded string
-		bindings := []*string{&info.SMDP, &info.MatchID, &info.ObjectID, &codeNeeded}
-		for index, value := range parts[1:] {
-			*bindings[index] = strings.TrimSpace(value)
+	return ac.PullInfo, ac.ConfirmCodeRequired, nil
+}
+
+// 聊天软件复制时常带入的不可见字符
+var invisibleReplacer = strings.NewReplacer(
+	"\u200b", "", // zero width space
+	"\u200c", "", // zero width non-joiner
+	"\u200d", "", // zero width joiner
+	"\u2060", "", // word joiner
+	"\ufeff", "", // byte order mark
+	"\u00ad", "", // soft hyphen
+)
+
+// CompleteActivationCode 将各种输入格式规范化为 LPA:1$ 开头的激活码
+// 返回值 steps 记录了实际应用的转换
+func CompleteActivationCode(input string) (code string, steps []string) {
+	code = invisibleReplacer.Replace(input)
+	if code != input {
+		steps = append(steps, "strip invisible characters")
+	}
+	if stripped := strings.Join(strings.Fields(code), ""); stripped != code {
+		code = stripped
+		steps = append(steps, "strip whitespace")
+	}
+	// https://esimsetup.apple.com/esim_qrcode_provisioning?carddata=LPA:1$...
+	lower := strings.ToLower(code)
+	if strings.HasPrefix(lower, "https://esimsetup.apple.com/") || strings.HasPrefix(lower, "http://esimsetup.apple.com/") {
+		if u, err := url.Parse(code); err == nil {
+			if cardData := u.Query().Get("carddata"); cardData != "" {
+				code = cardData
+				steps = append(steps, "extract carddata from apple esimsetup url")
+			}
+		}
+	}
+	// LPA%3A1%24rspAddr%24matchID
+	if strings.Contains(code, "%") {
+		if unescaped, err := url.PathUnescape(code); err == nil && unescaped != code {
+			code = unescaped
+			steps = append(steps, "url decode")
 		}
-		confirmCodeNeeded = codeNeeded == "1"
-		if info.SMDP != "" {
-			err = nil
+	}
+	// lpa:1$rspAddr$matchID
+	if len(code) >= len(activationCodeScheme) && strings.EqualFold(code[:len(activationCodeScheme)], activationCodeScheme) {
+		if !strings.HasPrefix(code, activationCodeScheme) {
+			code = activationCodeScheme + code[len(activationCodeScheme):]
+			steps = append(steps, "uppercase LPA: prefix")
 		}
+		return
+	}
+	// 1$rspAddr$matchID
+	if strings.HasPrefix(code, "1$") {
+		code = activationCodeScheme + code
+		steps = append(steps, "add LPA: prefix")
+		return
+	}
+	// $rspAddr$matchID
+	if strings.HasPrefix(code, "$") {
+		code = activationCodeScheme + "1" + code
+		steps = append(steps, "add LPA:1 prefix")
+		return
 	}
 	return
 }
 
-func CompleteActivationCode(input string) string {
-	// 如果输入已经以 LPA:1$ 开始，则认为它是完整的
-	if strings.HasPrefix(input, "LPA:1$") {
-		return input
+// DecodeQRCode 从 PNG 或 JPEG 图片中识别二维码内容
+func DecodeQRCode(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", errors.New("failed to decode image: " + err.Error())
 	}
-	// 1$rspAddr$matchID
-	if strings.HasPrefix(input, "1$") {
-		return "LPA:" + input
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", errors.New("failed to read image: " + err.Error())
 	}
-	// $rspAddr$matchID
-	if strings.HasPrefix(input, "$") {
-		return "LPA:1" + input
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, hints)
+	if err != nil {
+		return "", errors.New("no QR code found: " + err.Error())
+	}
+	return result.GetText(), nil
+}
+
+// randomString 使用 crypto/rand 从 charset 中生成 n 位随机字符
+func randomString(charset string, n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(charset)))
+	for i := range b {
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[index.Int64()]
+	}
+	return string(b), nil
+}
+
+// SplitCommand 按照 shell 规则拆分命令行，支持单引号、双引号和反斜杠转义
+func SplitCommand(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for i, r := range command {
+		switch {
+		case escaped:
+			// 双引号中的反斜杠只转义 " \ $ `
+			if quote == '"' && !strings.ContainsRune("\"\\$`", r) {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			if strings.ContainsRune("|&;<>", r) {
+				return nil, fmt.Errorf("unsupported shell character %q at position %d, quote it or use args", r, i)
+			}
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("command ends with an unfinished escape")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
 	}
-	return input
+	return args, nil
 }
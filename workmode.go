@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -13,33 +14,44 @@ type RLPAWorkMode interface {
 	Finished() bool
 }
 
+// WorkModeName 工作模式名称，用于 API 和事件
+func WorkModeName(m RLPAWorkMode) string {
+	switch m.(type) {
+	case *ShellWorkMode:
+		return "shell"
+	case *ProcessNotificationWorkMode:
+		return "notification"
+	case *DownloadWorkMode:
+		return "download"
+	case *ProvisionWorkMode:
+		return "provision"
+	default:
+		return "none"
+	}
+}
+
 type ShellWorkMode struct {
 }
 
 func (m *ShellWorkMode) Start(c *RLPAClient) {
 	// 添加到 Client 列表并发送 ID 和密码
-	APIClients = append(APIClients, c)
-	passwd := c.GenCredential()
-	err := c.MessageBox(fmt.Sprintf("ManageID: %s\nPassword: %s", c.ID, passwd))
+	c.assignRole()
+	passwd, err := Sessions.Register(c)
 	if err != nil {
-		c.ErrLog(err.Error())
+		c.ErrLog("Failed to generate credential: " + err.Error())
 		c.Close(ResultError)
 		return
 	}
-}
-
-func (m *ShellWorkMode) OnProcessFinished(c *RLPAClient, data *Payload) {
-	// TODO 完成，发送结果 json
-	resp, err := json.Marshal(data)
+	err = c.MessageBox(fmt.Sprintf("ManageID: %s\nPassword: %s", c.ID(), passwd))
 	if err != nil {
-		c.ResponseChan <- []byte(err.Error())
-		return
-	}
-	if c.ResponseWaiting {
-		c.ResponseChan <- resp
+		c.ErrLog(err.Error())
+		c.Close(ResultError)
 		return
 	}
+}
 
+func (m *ShellWorkMode) OnProcessFinished(c *RLPAClient, data *Payload) {
+	// 结果由 JobQueue 从 LpacProcess 中读取
 }
 
 func (m *ShellWorkMode) Finished() bool {
@@ -51,31 +63,33 @@ type ProcessNotificationWorkMode struct {
 	FailedCount   int
 	TotalCount    int
 	Notifications []*Notification
+	// OnDone 不为空时，处理结束后回调而不是关闭连接，用于串联工作模式
+	OnDone func(c *RLPAClient, err error)
 }
 
 func (m *ProcessNotificationWorkMode) Start(c *RLPAClient) {
 	m.State = 0
-	err := c.processOpenLpac("notification", "list")
+	_, err := c.processOpenLpac("notification", "list")
 	if err != nil {
-		c.Close(ResultError)
+		m.fail(c, err)
 		return
 	}
 }
 
 func (m *ProcessNotificationWorkMode) OnProcessFinished(c *RLPAClient, data *Payload) {
 	if data == nil {
-		c.Close(ResultError)
+		m.fail(c, errors.New("no lpac result"))
 		return
 	}
 	switch m.State {
 	case 0:
 		if data.Code != 0 {
-			c.Close(ResultError)
+			m.fail(c, errors.New("notification list failed"))
 			return
 		}
 		err := json.Unmarshal(data.Data, &m.Notifications)
 		if err != nil {
-			c.Close(ResultError)
+			m.fail(c, err)
 			return
 		}
 		m.State = 1
@@ -98,6 +112,15 @@ func (m *ProcessNotificationWorkMode) Finished() bool {
 	return m.State == 2
 }
 
+func (m *ProcessNotificationWorkMode) fail(c *RLPAClient, err error) {
+	if m.OnDone != nil {
+		m.State = 2
+		m.OnDone(c, err)
+		return
+	}
+	c.Close(ResultError)
+}
+
 func (m *ProcessNotificationWorkMode) processOneNotification(c *RLPAClient) {
 	// 如果没有通知，输出结果，并切换状态
 	if len(m.Notifications) == 0 {
@@ -107,13 +130,17 @@ func (m *ProcessNotificationWorkMode) processOneNotification(c *RLPAClient) {
 		} else {
 			c.InfoLog("All notification process successfully")
 		}
+		m.State = 2
+		if m.OnDone != nil {
+			m.OnDone(c, nil)
+			return
+		}
 		err := c.MessageBox(fmt.Sprint("All notification processing finished\n", m.TotalCount-m.FailedCount, " succeed\n", m.FailedCount, " failed"))
 		if err != nil {
 			c.Close(ResultError)
 		} else {
 			c.Close(ResultFinished)
 		}
-		m.State = 2
 		return
 	}
 	notification := m.Notifications[0]
@@ -125,52 +152,95 @@ func (m *ProcessNotificationWorkMode) processOneNotification(c *RLPAClient) {
 	case "enable":
 		fallthrough
 	case "disable":
-		err := c.processOpenLpac("notification", "process", strconv.Itoa(notification.SeqNumber), "-r")
+		_, err := c.processOpenLpac("notification", "process", strconv.Itoa(notification.SeqNumber), "-r")
 		if err != nil {
-			c.Close(ResultError)
+			m.fail(c, err)
 		}
 		break
 	case "delete":
-		err := c.processOpenLpac("notification", "process", strconv.Itoa(notification.SeqNumber))
+		_, err := c.processOpenLpac("notification", "process", strconv.Itoa(notification.SeqNumber))
 		if err != nil {
-			c.Close(ResultError)
+			m.fail(c, err)
 		}
 		break
 	default:
-		c.Close(ResultError)
+		m.fail(c, errors.New("unknown notification operation: "+notification.ProfileManagementOperation))
 	}
 }
 
+// 激活码与确认码之间的分隔符，例如 LPA:1$rsp.example.com$MATCHID#1234
+const confirmCodeSeparator = "#"
+
 type DownloadWorkMode struct {
 	State int
+	// Input 设备发送的激活码原文
+	Input       string
+	ConfirmCode string
 }
 
 func (m *DownloadWorkMode) Start(c *RLPAClient) {
 	m.State = 0
 	// 替换所有的 \x02 (STX) 字符为 $
-	data := strings.Replace(string(c.Packet.Value), string([]byte{0x02}), "$", -1)
+	data := strings.Replace(m.Input, string([]byte{0x02}), "$", -1)
 	// 替换所有的 \x11 (DC1) 字符为 _
 	data = strings.Replace(data, string([]byte{0x11}), "_", -1)
 	data = strings.TrimSpace(data)
-	pullInfo, confirmCodeNeeded, err := DecodeLpaActivationCode(CompleteActivationCode(data))
+	activationCode, confirmCode, _ := strings.Cut(data, confirmCodeSeparator)
+	activationCode = strings.TrimSpace(activationCode)
+	// 只输入了 PIN，取出通过 API 登记的激活码
+	if isPendingPIN(activationCode) {
+		// PIN 可以在公开的 RLPA 端口上猜测，错误次数计入 IP 的退避和封禁
+		ip := hostOf(c.Socket.RemoteAddr())
+		if wait, errGuard := Guard.Check(ip, ""); errGuard != nil || wait > 0 {
+			_ = c.MessageBox("Too many wrong PINs, retry later")
+			c.Close(ResultFinished)
+			return
+		}
+		entry, ok, errTake := Pending.Take(activationCode)
+		if errTake != nil {
+			c.ErrLog("pending store: " + errTake.Error())
+		}
+		if !ok {
+			Guard.Failure(ip, "")
+			_ = c.MessageBox("PIN not found or expired")
+			c.Close(ResultFinished)
+			return
+		}
+		c.InfoLog("Resolved pending download PIN")
+		activationCode = entry.ActivationCode
+		if strings.TrimSpace(confirmCode) == "" {
+			confirmCode = entry.ConfirmCode
+		}
+	}
+	activationCode, steps := CompleteActivationCode(activationCode)
+	if len(steps) > 0 {
+		c.DebugLog("activation code normalized (" + strings.Join(steps, ", ") + "): " + activationCode)
+	}
+	pullInfo, confirmCodeNeeded, err := DecodeLpaActivationCode(activationCode)
 	if err != nil {
 		_ = c.MessageBox(err.Error())
 		c.Close(ResultError)
 		return
 	}
-	if confirmCodeNeeded {
-		_ = c.MessageBox("Confirm Code is not supported yet")
+	pullInfo.ConfirmCode = strings.TrimSpace(confirmCode)
+	// 设备上没有输入确认码时，尝试使用通过 API 登记的确认码
+	if pullInfo.ConfirmCode == "" && pullInfo.MatchID != "" {
+		code, ok, errTake := Pending.TakeConfirmCode(pullInfo.MatchID)
+		if errTake != nil {
+			c.ErrLog("pending store: " + errTake.Error())
+		}
+		if ok {
+			c.DebugLog("use pending confirm code for " + pullInfo.MatchID)
+			pullInfo.ConfirmCode = code
+		}
+	}
+	if confirmCodeNeeded && pullInfo.ConfirmCode == "" {
+		_ = c.MessageBox("Confirmation Code required\nAppend it to the activation code after " + confirmCodeSeparator)
 		c.Close(ResultFinished)
 		return
 	}
-	args := []string{"profile", "download"}
-	if pullInfo.SMDP != "" {
-		args = append(args, "-s", pullInfo.SMDP)
-	}
-	if pullInfo.MatchID != "" {
-		args = append(args, "-m", pullInfo.MatchID)
-	}
-	err = c.processOpenLpac(args...)
+	m.ConfirmCode = pullInfo.ConfirmCode
+	_, err = c.processOpenLpac(downloadArgs(pullInfo)...)
 	if err != nil {
 		c.ErrLog(err.Error())
 		c.Close(ResultError)
@@ -187,16 +257,184 @@ func (m *DownloadWorkMode) OnProcessFinished(c *RLPAClient, data *Payload) {
 		_ = c.MessageBox("Download success")
 		c.Close(ResultFinished)
 	} else {
-		c.ErrLog("download error: " + string(data.Data))
-		// TODO 解析错误信息
-		// 也许把 EasyLPAC 代码搬过来
-		errorMsg := fmt.Sprint("Data: ", data.Data)
-		_ = c.MessageBox(errorMsg)
+		lpacErr := DecodeLpacError(data)
+		c.ErrLog("download error: " + lpacErr.Error())
+		// 确认码缺失和错误由是否输入过确认码区分
+		if lpacErr.Kind == LpacErrConfirmCodeRequired || lpacErr.Kind == LpacErrConfirmCodeWrong {
+			lpacErr.Kind = LpacErrConfirmCodeRequired
+			if m.ConfirmCode != "" {
+				lpacErr.Kind = LpacErrConfirmCodeWrong
+			}
+		}
+		_ = c.MessageBox(lpacErr.Localized(CFG().MessageLang))
 		c.Close(ResultError)
 	}
 	m.State = 1
 }
 
+func isPendingPIN(input string) bool {
+	cfg := CFG()
+	// 不只匹配当前的 PIN 长度，修改长度前发出的 PIN 仍然有效
+	if !cfg.Features.Pending || len(input) < minPendingPINLength || len(input) > maxPendingPINLength {
+		return false
+	}
+	for _, r := range input {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadArgs 生成 lpac profile download 参数
+func downloadArgs(info PullInfo) []string {
+	args := []string{"profile", "download"}
+	if info.SMDP != "" {
+		args = append(args, "-s", info.SMDP)
+	}
+	if info.MatchID != "" {
+		args = append(args, "-m", info.MatchID)
+	}
+	if info.ConfirmCode != "" {
+		args = append(args, "-c", info.ConfirmCode)
+	}
+	if info.IMEI != "" {
+		args = append(args, "-i", info.IMEI)
+	}
+	return args
+}
+
+func (m *DownloadWorkMode) OnProgress(c *RLPAClient, event *ProgressEvent) {
+	if !event.Notify {
+		return
+	}
+	err := c.MessageBox(event.String())
+	if err != nil {
+		c.ErrLog("Failed to send progress: " + err.Error())
+	}
+}
+
 func (m *DownloadWorkMode) Finished() bool {
 	return m.State == 1
 }
+
+// ProvisionWorkMode 读取 EID 并执行预先排队的操作，完成后进入设备请求的工作模式
+type ProvisionWorkMode struct {
+	State        int
+	Next         RLPAWorkMode
+	EID          string
+	Ops          []ProvisionOperation
+	Current      int
+	FailedCount  int
+	Notification *ProcessNotificationWorkMode
+}
+
+func (m *ProvisionWorkMode) Start(c *RLPAClient) {
+	m.State = 0
+	_, err := c.processOpenLpac("chip", "info")
+	if err != nil {
+		c.ErrLog("provision: " + err.Error())
+		m.startNext(c)
+	}
+}
+
+func (m *ProvisionWorkMode) OnProcessFinished(c *RLPAClient, data *Payload) {
+	switch m.State {
+	case 0:
+		var info LpacChipInfo
+		if data == nil || data.Code != 0 || json.Unmarshal(data.Data, &info) != nil || info.EID == "" {
+			c.ErrLog("provision: failed to read EID")
+			m.startNext(c)
+			return
+		}
+		m.EID = info.EID
+		m.Ops = Provisioning.Claim(m.EID, c.Serial)
+		if len(m.Ops) == 0 {
+			m.startNext(c)
+			return
+		}
+		c.InfoLog(fmt.Sprint("Provisioning ", len(m.Ops), " queued operations for EID ", m.EID))
+		m.State = 1
+		m.Current = -1
+		m.runNextOperation(c)
+	case 1:
+		op := m.Ops[m.Current]
+		if lpacErr := DecodeLpacError(data); lpacErr != nil {
+			m.record(c, op, false, lpacErr.Error())
+		} else {
+			m.record(c, op, true, "")
+		}
+		m.runNextOperation(c)
+	case 2:
+		m.Notification.OnProcessFinished(c, data)
+	}
+}
+
+func (m *ProvisionWorkMode) Finished() bool {
+	return m.State == 3
+}
+
+func (m *ProvisionWorkMode) record(c *RLPAClient, op ProvisionOperation, succeeded bool, result string) {
+	if succeeded {
+		c.InfoLog("Provision " + op.Type + " " + op.ID + " succeeded")
+	} else {
+		c.ErrLog("Provision " + op.Type + " " + op.ID + " failed: " + result)
+		m.FailedCount++
+	}
+	Provisioning.Record(m.EID, op.ID, succeeded, result)
+}
+
+func (m *ProvisionWorkMode) runNextOperation(c *RLPAClient) {
+	m.Current++
+	if m.Current >= len(m.Ops) {
+		_ = c.MessageBox(fmt.Sprint("Provisioning finished\n", len(m.Ops)-m.FailedCount, " succeed\n", m.FailedCount, " failed"))
+		m.startNext(c)
+		return
+	}
+	op := m.Ops[m.Current]
+	m.State = 1
+	var err error
+	switch op.Type {
+	case ProvisionDownload:
+		var info PullInfo
+		info, _, err = DecodeLpaActivationCode(op.ActivationCode)
+		if err == nil {
+			info.ConfirmCode = op.ConfirmCode
+			_, err = c.processOpenLpac(downloadArgs(info)...)
+		}
+	case ProvisionEnable:
+		_, err = c.processOpenLpac("profile", "enable", op.ICCID)
+	case ProvisionNickname:
+		_, err = c.processOpenLpac("profile", "nickname", op.ICCID, op.Nickname)
+	case ProvisionNotification:
+		m.State = 2
+		m.Notification = &ProcessNotificationWorkMode{
+			OnDone: func(c *RLPAClient, err error) {
+				switch {
+				case err != nil:
+					m.record(c, op, false, err.Error())
+				case m.Notification.FailedCount != 0:
+					m.record(c, op, false, fmt.Sprint(m.Notification.FailedCount, " of ", m.Notification.TotalCount, " notifications failed"))
+				default:
+					m.record(c, op, true, fmt.Sprint(m.Notification.TotalCount, " notifications processed"))
+				}
+				m.runNextOperation(c)
+			},
+		}
+		m.Notification.Start(c)
+		return
+	default:
+		err = errors.New("unknown operation type: " + op.Type)
+	}
+	if err != nil {
+		m.record(c, op, false, err.Error())
+		m.runNextOperation(c)
+	}
+}
+
+// startNext 切换到设备原本请求的工作模式
+func (m *ProvisionWorkMode) startNext(c *RLPAClient) {
+	m.State = 3
+	c.SetWorkMode(m.Next)
+	m.Next.Start(c)
+}